@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/url"
 	"os"
+	"strings"
 
 	"github.com/pulumi/pulumi-gcp/sdk/v4/go/gcp/cloudfunctions"
 	"github.com/pulumi/pulumi-gcp/sdk/v4/go/gcp/cloudscheduler"
@@ -20,6 +21,33 @@ var billingAccountID = os.Getenv("BILLING_ACCOUNT_ID")
 var functionKey = os.Getenv("FUNCTION_KEY")
 var cleanBucketAfterDays = 7
 
+// functionSettings maps the stack config to the environment of the functions,
+// set them with "pulumi config set maxInFlight 20". Settings that are not set use the defaults of the functions.
+var functionSettings = map[string]string{
+	"syncMaxDuration":        "SYNC_MAX_DURATION",
+	"lowConfidenceThreshold": "LOW_CONFIDENCE_THRESHOLD",
+	"reviewThreshold":        "REVIEW_THRESHOLD",
+	"batchConcurrency":       "BATCH_CONCURRENCY",
+	"defaultLanguage":        "DEFAULT_LANGUAGE",
+	"maxDownloadSize":        "MAX_DOWNLOAD_SIZE",
+	"awsAccessKeyId":         "AWS_ACCESS_KEY_ID",
+	"awsRegion":              "AWS_REGION",
+	"s3Endpoint":             "S3_ENDPOINT",
+	"uploadURLExpiry":        "UPLOAD_URL_EXPIRY",
+	"signingAccount":         "SIGNING_ACCOUNT",
+	"uploadOrigins":          "UPLOAD_ORIGINS",
+	"maxRetries":             "MAX_RETRIES",
+	"maxProcessingAge":       "MAX_PROCESSING_AGE",
+	"maxInFlight":            "MAX_IN_FLIGHT",
+}
+
+// functionSecrets are like functionSettings, set with "pulumi config set --secret"
+var functionSecrets = map[string]string{
+	"awsSecretAccessKey": "AWS_SECRET_ACCESS_KEY",
+	"awsSessionToken":    "AWS_SESSION_TOKEN",
+	"uploadKey":          "UPLOAD_KEY",
+}
+
 func appendFunctionKey(s string) string {
 	parsed, err := url.Parse(s)
 	if err != nil {
@@ -95,11 +123,31 @@ func main() {
 			},
 		}
 
+		// Browsers on the uploadOrigins upload into the ingest bucket with the urls from UploadURL
+		cfg := config.New(ctx, "")
+		uploadOrigins := pulumi.StringArray{}
+		for _, origin := range strings.Split(cfg.Get("uploadOrigins"), ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				uploadOrigins = append(uploadOrigins, pulumi.String(origin))
+			}
+		}
+
+		uploadCors := storage.BucketCorArray{}
+		if len(uploadOrigins) > 0 {
+			uploadCors = append(uploadCors, &storage.BucketCorArgs{
+				Methods:         pulumi.StringArray{pulumi.String("PUT")},
+				Origins:         uploadOrigins,
+				ResponseHeaders: pulumi.StringArray{pulumi.String("Content-Type")},
+				MaxAgeSeconds:   pulumi.IntPtr(3600),
+			})
+		}
+
 		ingestBucket, err := storage.NewBucket(ctx, fmt.Sprintf("%s-ingest", gcpProjectID), &storage.BucketArgs{
 			Location:                 pulumi.String("EUROPE-WEST3"),
 			Project:                  pulumi.String(gcpProjectID),
 			UniformBucketLevelAccess: pulumi.BoolPtr(false),
 			LifecycleRules:           &bucketLifecycle,
+			Cors:                     uploadCors,
 		}, pulumi.DependsOn([]pulumi.Resource{project}))
 		if err != nil {
 			return err
@@ -121,6 +169,17 @@ func main() {
 			"RESULT_BUCKET": outputBucket.Name,
 		}
 
+		for key, env := range functionSettings {
+			if value := cfg.Get(key); value != "" {
+				functionEnv[env] = pulumi.String(value)
+			}
+		}
+		for key, env := range functionSecrets {
+			if value, err := cfg.TrySecret(key); err == nil {
+				functionEnv[env] = value
+			}
+		}
+
 		// Set arguments for creating the function resource.
 		argsIngestFunc := &cloudfunctions.FunctionArgs{
 			SourceArchiveBucket:  codeBucket.Name,
@@ -128,7 +187,8 @@ func main() {
 			SourceArchiveObject:  bucketObject.Name,
 			EntryPoint:           pulumi.String("Ingest"),
 			TriggerHttp:          pulumi.Bool(true),
-			AvailableMemoryMb:    pulumi.Int(128),
+			AvailableMemoryMb:    pulumi.Int(512),
+			Timeout:              pulumi.Int(540),
 			Project:              pulumi.String(gcpProjectID),
 			EnvironmentVariables: functionEnv,
 		}
@@ -195,6 +255,132 @@ func main() {
 			return err
 		}
 
+		// httpFunction deploys one of the HTTP endpoints that anyone with the function key can call
+		httpFunction := func(name, entryPoint string, memory, timeout int) (*cloudfunctions.Function, error) {
+			function, err := cloudfunctions.NewFunction(ctx, name, &cloudfunctions.FunctionArgs{
+				SourceArchiveBucket:  codeBucket.Name,
+				Runtime:              pulumi.String("go113"),
+				SourceArchiveObject:  bucketObject.Name,
+				EntryPoint:           pulumi.String(entryPoint),
+				TriggerHttp:          pulumi.Bool(true),
+				AvailableMemoryMb:    pulumi.Int(memory),
+				Timeout:              pulumi.Int(timeout),
+				Project:              pulumi.String(gcpProjectID),
+				EnvironmentVariables: functionEnv,
+			}, pulumi.DependsOn(
+				[]pulumi.Resource{
+					bucketObject,
+					project,
+					cfAPI,
+				},
+			))
+			if err != nil {
+				return nil, err
+			}
+
+			_, err = cloudfunctions.NewFunctionIamMember(ctx, fmt.Sprintf("%sInvoker", name), &cloudfunctions.FunctionIamMemberArgs{
+				Project:       function.Project,
+				Region:        function.Region,
+				CloudFunction: function.Name,
+				Role:          pulumi.String("roles/cloudfunctions.invoker"),
+				Member:        pulumi.String("allUsers"),
+			})
+			return function, err
+		}
+
+		statusFunc, err := httpFunction("statusFunc", "Status", 128, 60)
+		if err != nil {
+			return err
+		}
+
+		transitionFunc, err := httpFunction("transitionFunc", "Transition", 128, 60)
+		if err != nil {
+			return err
+		}
+
+		importFunc, err := httpFunction("importFunc", "ImportSubtitles", 256, 60)
+		if err != nil {
+			return err
+		}
+
+		versionsFunc, err := httpFunction("versionsFunc", "Versions", 128, 60)
+		if err != nil {
+			return err
+		}
+
+		batchFunc, err := httpFunction("batchFunc", "Batch", 512, 540)
+		if err != nil {
+			return err
+		}
+
+		iamCredentialsAPI, err := projects.NewService(ctx, "iamCredentialsAPI", &projects.ServiceArgs{
+			DisableDependentServices: pulumi.Bool(true),
+			Project:                  pulumi.String(gcpProjectID),
+			Service:                  pulumi.String("iamcredentials.googleapis.com"),
+		}, pulumi.DependsOn([]pulumi.Resource{project}))
+		if err != nil {
+			return err
+		}
+
+		// The functions sign the upload urls with their own account
+		_, err = serviceaccount.NewIAMMember(ctx, "uploadURLSigner", &serviceaccount.IAMMemberArgs{
+			ServiceAccountId: pulumi.Sprintf("projects/%s/serviceAccounts/%s@appspot.gserviceaccount.com", project.ProjectId, project.ProjectId),
+			Role:             pulumi.String("roles/iam.serviceAccountTokenCreator"),
+			Member:           pulumi.Sprintf("serviceAccount:%s@appspot.gserviceaccount.com", project.ProjectId),
+		}, pulumi.DependsOn([]pulumi.Resource{iamCredentialsAPI}))
+		if err != nil {
+			return err
+		}
+
+		uploadURLFunc, err := httpFunction("uploadURLFunc", "UploadURL", 128, 60)
+		if err != nil {
+			return err
+		}
+
+		cancelFunc, err := httpFunction("cancelFunc", "Cancel", 128, 60)
+		if err != nil {
+			return err
+		}
+
+		retryFunc, err := httpFunction("retryFunc", "Retry", 512, 540)
+		if err != nil {
+			return err
+		}
+
+		stuckJobsFunc, err := httpFunction("stuckJobsFunc", "StuckJobs", 256, 120)
+		if err != nil {
+			return err
+		}
+
+		// Start jobs for files uploaded to the ingest bucket
+		_, err = cloudfunctions.NewFunction(ctx, "uploadFunc", &cloudfunctions.FunctionArgs{
+			SourceArchiveBucket: codeBucket.Name,
+			Runtime:             pulumi.String("go113"),
+			SourceArchiveObject: bucketObject.Name,
+			EntryPoint:          pulumi.String("OnUpload"),
+			EventTrigger: &cloudfunctions.FunctionEventTriggerArgs{
+				EventType: pulumi.String("google.storage.object.finalize"),
+				Resource:  ingestBucket.Name,
+				// OnUpload returns the errors that may go away, like a failing speech API
+				FailurePolicy: &cloudfunctions.FunctionEventTriggerFailurePolicyArgs{
+					Retry: pulumi.Bool(true),
+				},
+			},
+			AvailableMemoryMb:    pulumi.Int(512),
+			Timeout:              pulumi.Int(540),
+			Project:              pulumi.String(gcpProjectID),
+			EnvironmentVariables: functionEnv,
+		}, pulumi.DependsOn(
+			[]pulumi.Resource{
+				bucketObject,
+				project,
+				cfAPI,
+			},
+		))
+		if err != nil {
+			return err
+		}
+
 		bucketPerms := pulumi.StringArray{
 			pulumi.Sprintf("OWNER:user-%s", pulumiServiceAccount),
 			pulumi.Sprintf("READER:user-%s@appspot.gserviceaccount.com", project.ProjectId),
@@ -259,6 +445,15 @@ func main() {
 		ctx.Export("outputBucket", outputBucket.Url)
 		ctx.Export("ingestTrigger", ingestFunc.HttpsTriggerUrl)
 		ctx.Export("resultTrigger", resultFunc.HttpsTriggerUrl)
+		ctx.Export("statusTrigger", statusFunc.HttpsTriggerUrl)
+		ctx.Export("transitionTrigger", transitionFunc.HttpsTriggerUrl)
+		ctx.Export("importTrigger", importFunc.HttpsTriggerUrl)
+		ctx.Export("versionsTrigger", versionsFunc.HttpsTriggerUrl)
+		ctx.Export("batchTrigger", batchFunc.HttpsTriggerUrl)
+		ctx.Export("uploadURLTrigger", uploadURLFunc.HttpsTriggerUrl)
+		ctx.Export("cancelTrigger", cancelFunc.HttpsTriggerUrl)
+		ctx.Export("retryTrigger", retryFunc.HttpsTriggerUrl)
+		ctx.Export("stuckJobsTrigger", stuckJobsFunc.HttpsTriggerUrl)
 		return nil
 	})
 }
@@ -0,0 +1,314 @@
+package stt
+
+import (
+	"math"
+	"strings"
+	"unicode"
+
+	"github.com/asticode/go-astisub"
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1p1beta1"
+)
+
+// normalizeWord makes words comparable regardless of case and punctuation
+func normalizeWord(w string) string {
+	return strings.ToLower(strings.TrimFunc(w, unicode.IsPunct))
+}
+
+// Costs of the edit operations in alignWords. A substitution costs less than a deletion and an insertion,
+// but more than either of them, so runs of words are not shifted to line up mismatching words.
+const (
+	gapCost          = 2
+	substitutionCost = 3
+)
+
+// alignWords returns for every corrected word the index of the recognized word it corresponds to
+// in a minimum edit distance alignment, or -1 if the word was inserted.
+// Substituted words correspond to the word they replace.
+func alignWords(recognized []Word, corrected []string) []int {
+	n, m := len(recognized), len(corrected)
+
+	// cost[i][j] is the distance between the first i recognized and the first j corrected words
+	cost := make([][]int, n+1)
+	for i := range cost {
+		cost[i] = make([]int, m+1)
+		cost[i][0] = i * gapCost
+	}
+	for j := range cost[0] {
+		cost[0][j] = j * gapCost
+	}
+
+	substitution := func(i, j int) int {
+		if normalizeWord(recognized[i-1].Word) == normalizeWord(corrected[j-1]) {
+			return 0
+		}
+		return substitutionCost
+	}
+
+	for i := 1; i <= n; i++ {
+		for j := 1; j <= m; j++ {
+			c := cost[i-1][j-1] + substitution(i, j)
+			if cost[i-1][j]+gapCost < c {
+				c = cost[i-1][j] + gapCost
+			}
+			if cost[i][j-1]+gapCost < c {
+				c = cost[i][j-1] + gapCost
+			}
+			cost[i][j] = c
+		}
+	}
+
+	matches := make([]int, m)
+	for j := range matches {
+		matches[j] = -1
+	}
+
+	i, j := n, m
+	for i > 0 && j > 0 {
+		if cost[i][j] == cost[i-1][j-1]+substitution(i, j) {
+			matches[j-1] = i - 1
+			i--
+			j--
+		} else if cost[i][j] == cost[i-1][j]+gapCost {
+			i--
+		} else {
+			j--
+		}
+	}
+
+	return matches
+}
+
+// alignCue times the corrected words of a subtitle shown from start to end.
+// Recognized words belong to the subtitle their middle is in.
+func alignCue(recognized []Word, start, end float64, corrected []string) []Word {
+	window := []Word{}
+	for _, w := range recognized {
+		if middle := (w.Start + w.End) / 2; middle >= start && middle < end {
+			window = append(window, w)
+		}
+	}
+
+	// The editor confirmed the corrected words, so they do not keep the confidence of the recognition
+	return timeWords(window, corrected, alignWords(window, corrected), start, end, false)
+}
+
+// unmatchedConfidence is given to script words the recognizer did not hear, so they are flagged for the review
+const unmatchedConfidence = 0.01
+
+// timeWords gives the words the timings of the recognized words they are matched with, limited to start and end,
+// and spreads the others evenly over the time left between their neighbours.
+// With keepConfidence words that are the same as the recognized word keep its confidence, the others have none.
+func timeWords(recognized []Word, text []string, matches []int, start, end float64, keepConfidence bool) []Word {
+	words := make([]Word, len(text))
+	timed := make([]bool, len(text))
+	for j, w := range text {
+		words[j].Word = w
+		if i := matches[j]; i >= 0 {
+			words[j].Start = math.Max(recognized[i].Start, start)
+			words[j].End = math.Min(recognized[i].End, end)
+			timed[j] = words[j].Start <= words[j].End
+			if keepConfidence && normalizeWord(recognized[i].Word) == normalizeWord(w) {
+				words[j].Confidence = recognized[i].Confidence
+			}
+		}
+	}
+
+	for j := 0; j < len(words); {
+		if timed[j] {
+			j++
+			continue
+		}
+
+		k := j
+		for k < len(words) && !timed[k] {
+			k++
+		}
+
+		from := start
+		if j > 0 {
+			from = words[j-1].End
+		}
+
+		to := end
+		if k < len(words) {
+			to = words[k].Start
+		}
+
+		step := math.Max(to-from, 0) / float64(k-j)
+		for x := j; x < k; x++ {
+			words[x].Start = from + step*float64(x-j)
+			words[x].End = words[x].Start + step
+		}
+
+		j = k
+	}
+
+	return words
+}
+
+// languageAt returns the recognized language at the given time
+func (t Transcript) languageAt(at float64) string {
+	for _, s := range t.Segments {
+		if s.End > at && s.Language != "" {
+			return s.Language
+		}
+	}
+	return t.Language
+}
+
+// importSubtitles builds a transcript from corrected subtitles, one segment per subtitle,
+// using the word timings of the recognized transcript
+func importSubtitles(recognized Transcript, subs *astisub.Subtitles) Transcript {
+	words := []Word{}
+	for _, s := range recognized.Segments {
+		words = append(words, s.Words...)
+	}
+
+	t := Transcript{
+		Language: recognized.Language,
+		Segments: []Segment{},
+	}
+
+	for _, item := range subs.Items {
+		corrected := []string{}
+		for _, l := range item.Lines {
+			for _, li := range l.Items {
+				corrected = append(corrected, strings.Fields(strings.Replace(li.Text, rightToLeftMark, "", -1))...)
+			}
+		}
+
+		if len(corrected) == 0 {
+			continue
+		}
+
+		start, end := item.StartAt.Seconds(), item.EndAt.Seconds()
+		lang := recognized.languageAt(start)
+		rules := rulesFor(lang)
+
+		segment := Segment{
+			Language: lang,
+			Words:    alignCue(words, start, end, corrected),
+		}
+
+		for _, w := range corrected {
+			segment.Text = rules.appendWord(segment.Text, w)
+		}
+
+		segment.Start = segment.Words[0].Start
+		segment.End = segment.Words[len(segment.Words)-1].End
+		t.Segments = append(t.Segments, segment)
+	}
+
+	return t
+}
+
+// alignWindow is the number of script words aligned at once, which bounds the memory used for long scripts
+const alignWindow = 1000
+
+// alignScript returns for every script word the index of the recognized word it corresponds to, or -1.
+// The script is aligned in windows that overlap by half, of which only the first half is kept,
+// except for the last one.
+func alignScript(recognized []Word, script []string) []int {
+	matches := make([]int, 0, len(script))
+	r := 0
+	for s := 0; s < len(script); {
+		sEnd := s + alignWindow
+		if sEnd > len(script) {
+			sEnd = len(script)
+		}
+
+		// Leave room for words the recognizer heard that are not in the script
+		rEnd := r + 2*(sEnd-s)
+		if rEnd > len(recognized) {
+			rEnd = len(recognized)
+		}
+
+		window := alignWords(recognized[r:rEnd], script[s:sEnd])
+		keep := len(window)
+		if sEnd < len(script) {
+			keep = len(window) / 2
+		}
+
+		next := r
+		for _, i := range window[:keep] {
+			if i >= 0 {
+				i += r
+				next = i + 1
+			}
+			matches = append(matches, i)
+		}
+
+		r = next
+		s += keep
+	}
+
+	return matches
+}
+
+// scriptTranscript replaces the recognized text with the script, one segment per line of the script.
+// The script words take the timings and confidences of the recognized words. If the recognizer
+// reported confidences, script words it did not hear get unmatchedConfidence.
+func scriptTranscript(recognized Transcript, script string) Transcript {
+	words := []Word{}
+	hasConfidence := false
+	for _, s := range recognized.Segments {
+		words = append(words, s.Words...)
+		for _, w := range s.Words {
+			hasConfidence = hasConfidence || w.Confidence > 0
+		}
+	}
+
+	t := Transcript{
+		Language: recognized.Language,
+		Segments: []Segment{},
+	}
+
+	if len(words) == 0 {
+		return t
+	}
+
+	lines := [][]string{}
+	scriptWords := []string{}
+	for _, line := range strings.Split(strings.Replace(script, "\r", "", -1), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			lines = append(lines, fields)
+			scriptWords = append(scriptWords, fields...)
+		}
+	}
+
+	timed := timeWords(words, scriptWords, alignScript(words, scriptWords), words[0].Start, words[len(words)-1].End, true)
+	if hasConfidence {
+		for i := range timed {
+			if timed[i].Confidence == 0 {
+				timed[i].Confidence = unmatchedConfidence
+			}
+		}
+	}
+
+	for _, line := range lines {
+		segment := Segment{
+			Start: timed[0].Start,
+			End:   timed[len(line)-1].End,
+			Words: timed[:len(line)],
+		}
+		segment.Language = recognized.languageAt(segment.Start)
+
+		rules := rulesFor(segment.Language)
+		for _, w := range line {
+			segment.Text = rules.appendWord(segment.Text, w)
+		}
+
+		t.Segments = append(t.Segments, segment)
+		timed = timed[len(line):]
+	}
+
+	return t
+}
+
+// withScript replaces the text of the results with the script of the request, if it has one
+func (r IngestRequest) withScript(results []*speechpb.SpeechRecognitionResult) []*speechpb.SpeechRecognitionResult {
+	if strings.TrimSpace(r.Script) == "" {
+		return results
+	}
+	return scriptTranscript(transcriptFromResults(results, r.Language), r.Script).results()
+}
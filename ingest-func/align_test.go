@@ -0,0 +1,125 @@
+package stt
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1p1beta1"
+)
+
+func Test_alignWords(t *testing.T) {
+	recognized := []Word{{Word: "Velkommen"}, {Word: "til"}, {Word: "brun"}, {Word: "stad"}}
+	assert.Equal(t, []int{0, 1, 3}, alignWords(recognized, []string{"velkommen", "til", "Brunstad."}))
+	assert.Equal(t, []int{0, -1, 1, 2, 3}, alignWords(recognized, []string{"Velkommen", "alle", "til", "brun", "stad"}))
+}
+
+func Test_importSubtitles(t *testing.T) {
+	recognized := transcriptFromResults([]*speechpb.SpeechRecognitionResult{
+		testResult("", 0, "Velkommen", "til", "brun", "stad"),
+		testResult("", 4*time.Second, "god", "morgen"),
+	}, "no-NO")
+
+	subs, err := readSubtitles([]byte("1\n00:00:00,000 --> 00:00:04,000\nVelkommen til Brunstad.\n\n2\n00:00:04,000 --> 00:00:06,000\nGod morgen alle sammen!\n"), "")
+	assert.Nil(t, err)
+
+	transcript := importSubtitles(recognized, subs)
+	assert.Len(t, transcript.Segments, 2)
+	assert.Equal(t, "Velkommen til Brunstad.", transcript.Segments[0].Text)
+	assert.Equal(t, Word{Word: "Brunstad.", Start: 3, End: 4}, transcript.Segments[0].Words[2])
+	assert.Equal(t, "no-NO", transcript.Segments[1].Language)
+
+	// The inserted words share the time after the last recognized word
+	words := transcript.Segments[1].Words
+	assert.Equal(t, Word{Word: "morgen", Start: 5, End: 6}, words[1])
+	assert.Equal(t, 6.0, words[2].Start)
+	assert.Equal(t, 6.0, words[3].End)
+
+	assert.Equal(t, "Velkommen til Brunstad. God morgen alle sammen!\n", transcriptionToPlainText(transcript.results(), 25, false, rulesFor("no")))
+}
+
+func Test_importSubtitles_confidence(t *testing.T) {
+	recognized := transcriptFromResults([]*speechpb.SpeechRecognitionResult{testResult("", 0, "god", "morgen")}, "no-NO")
+	recognized.Segments[0].Words[1].Confidence = 0.2
+
+	subs, err := readSubtitles([]byte("1\n00:00:00,000 --> 00:00:02,000\nGod morgen\n"), "")
+	assert.Nil(t, err)
+
+	// Words confirmed by the editor are not flagged as low confidence
+	transcript := importSubtitles(recognized, subs)
+	assert.Equal(t, float32(0), transcript.Segments[0].Words[1].Confidence)
+	assert.Equal(t, "God morgen\n", transcriptionToPlainText(bracketLowConfidence(transcript.results()), 25, false, rulesFor("no")))
+}
+
+func Test_readSubtitles_vtt(t *testing.T) {
+	subs, err := readSubtitles([]byte("WEBVTT\n\n00:00:01.000 --> 00:00:02.500\nHei\n"), "")
+	assert.Nil(t, err)
+	assert.Len(t, subs.Items, 1)
+	assert.Equal(t, 2500*time.Millisecond, subs.Items[0].EndAt)
+
+	_, err = readSubtitles([]byte(""), "ttml")
+	assert.True(t, strings.Contains(err.Error(), "Unknown subtitle format"))
+}
+
+func Test_scriptTranscript(t *testing.T) {
+	recognized := transcriptFromResults([]*speechpb.SpeechRecognitionResult{
+		testResult("", 0, "velkommen", "til", "brun", "stad", "og", "god", "morgen"),
+	}, "no-NO")
+
+	transcript := scriptTranscript(recognized, "Velkommen til Brunstad.\n\nGod morgen, alle sammen!\n")
+	assert.Len(t, transcript.Segments, 2)
+	assert.Equal(t, "Velkommen til Brunstad.", transcript.Segments[0].Text)
+	assert.Equal(t, "God morgen, alle sammen!", transcript.Segments[1].Text)
+	assert.Equal(t, 0.0, transcript.Segments[0].Start)
+	assert.Equal(t, Word{Word: "God", Start: 5, End: 6}, transcript.Segments[1].Words[0])
+	assert.Equal(t, 7.0, transcript.Segments[1].End)
+}
+
+func Test_scriptTranscript_confidence(t *testing.T) {
+	recognized := transcriptFromResults([]*speechpb.SpeechRecognitionResult{
+		testResult("", 0, "velkommen", "til", "brunstad", "god", "morgen"),
+	}, "no-NO")
+	for i := range recognized.Segments[0].Words {
+		recognized.Segments[0].Words[i].Confidence = 0.9
+	}
+	recognized.Segments[0].Words[2].Confidence = 0.4
+
+	transcript := scriptTranscript(recognized, "Velkommen til Brunstad.\nGod dag, alle sammen!\n")
+	words := append(transcript.Segments[0].Words, transcript.Segments[1].Words...)
+	confidences := []float32{}
+	for _, w := range words {
+		confidences = append(confidences, w.Confidence)
+	}
+	// "dag" replaces "morgen" and "alle sammen" were not heard
+	assert.Equal(t, []float32{0.9, 0.9, 0.4, 0.9, unmatchedConfidence, unmatchedConfidence, unmatchedConfidence}, confidences)
+
+	stats := transcript.markLowConfidence()
+	assert.Equal(t, 7, stats.Words)
+	assert.Equal(t, 4, stats.LowConfidenceWords)
+	assert.True(t, stats.needsReview(0.6))
+}
+
+func Test_alignScript(t *testing.T) {
+	recognized := []Word{}
+	script := []string{}
+	for i := 0; i < 3*alignWindow; i++ {
+		w := fmt.Sprintf("w%d", i)
+		script = append(script, w)
+		if i%10 != 0 {
+			// The recognizer missed every 10th word
+			recognized = append(recognized, Word{Word: w})
+		}
+	}
+
+	matches := alignScript(recognized, script)
+	assert.Len(t, matches, len(script))
+	for j, i := range matches {
+		if j%10 == 0 {
+			assert.Equal(t, -1, i)
+		} else {
+			assert.Equal(t, script[j], recognized[i].Word)
+		}
+	}
+}
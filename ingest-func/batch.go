@@ -0,0 +1,150 @@
+package stt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+
+	speech "cloud.google.com/go/speech/apiv1p1beta1"
+	"cloud.google.com/go/storage"
+)
+
+// maxBatchLine limits the size of one request in a batch
+const maxBatchLine = 10 * 1024 * 1024
+
+// batchConcurrency is how many jobs of a batch are started at the same time
+var batchConcurrency = parseBatchConcurrency(envOrDefault("BATCH_CONCURRENCY", "5"))
+
+func parseBatchConcurrency(s string) int {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		log.Printf("Invalid BATCH_CONCURRENCY \"%s\", using 1", s)
+		return 1
+	}
+	return n
+}
+
+// BatchResult reports the outcome of one line of a batch
+type BatchResult struct {
+	Line   int    `json:"line"`
+	File   string `json:"file,omitempty"`
+	JobID  string `json:"job_id,omitempty"`
+	Status string `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// startBatch starts a job for every line of JSONL, at most concurrency at a time.
+// Empty lines are skipped, the results are in the order of the lines.
+// If the JSONL can not be read to the end, the last result has the error.
+func startBatch(ctx context.Context, jsonl io.Reader, concurrency int, start func(context.Context, IngestRequest) (FileStatus, error)) []BatchResult {
+	results := []BatchResult{}
+	mutex := sync.Mutex{}
+	slots := make(chan bool, concurrency)
+	wg := sync.WaitGroup{}
+
+	scanner := bufio.NewScanner(jsonl)
+	scanner.Buffer(make([]byte, 64*1024), maxBatchLine)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		result := BatchResult{Line: line}
+		reqData := IngestRequest{}
+		err := json.Unmarshal(scanner.Bytes(), &reqData)
+		if err != nil {
+			result.Error = fmt.Sprintf("Error parsing request: %v", err)
+		}
+		result.File = reqData.File
+
+		mutex.Lock()
+		i := len(results)
+		results = append(results, result)
+		mutex.Unlock()
+
+		if err != nil {
+			continue
+		}
+
+		wg.Add(1)
+		slots <- true
+		go func(i int, reqData IngestRequest) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			fStatus, err := start(ctx, reqData)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				results[i].Error = err.Error()
+				return
+			}
+			results[i].JobID = fStatus.JobID
+			results[i].Status = fStatus.Status
+		}(i, reqData)
+	}
+
+	wg.Wait()
+
+	if err := scanner.Err(); err != nil {
+		// The lines read so far were started, so they are reported too
+		results = append(results, BatchResult{Line: line + 1, Error: fmt.Sprintf("Error reading batch: %v", err)})
+	}
+
+	return results
+}
+
+// Batch starts a job for every line of a JSONL body, or of the JSONL file in the ingest bucket
+// given in the "object" parameter. It responds with a result for every line.
+func Batch(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.URL.Query().Get("key") != apiKey {
+		sendError(w, "Wrong key", http.StatusUnauthorized)
+		return
+	}
+
+	client, err := speech.NewClient(ctx)
+	if err != nil {
+		sendError(w, "Can't connect to speech API. See log for more details.", http.StatusBadRequest)
+		return
+	}
+
+	storageClient, err := storage.NewClient(ctx)
+	if err != nil {
+		sendError(w, fmt.Sprintf("Unable to create a storage client: %+v", err), http.StatusInternalServerError)
+		return
+	}
+
+	jsonl := io.Reader(r.Body)
+	if object := r.URL.Query().Get("object"); object != "" {
+		reader, err := storageClient.Bucket(ingestBucketID).Object(object).NewReader(ctx)
+		if err == storage.ErrObjectNotExist {
+			sendError(w, fmt.Sprintf("Could not locate batch \"%s\"", object), http.StatusNotFound)
+			return
+		} else if err != nil {
+			sendError(w, fmt.Sprintf("Unable to read batch: %+v", err), http.StatusInternalServerError)
+			return
+		}
+		defer reader.Close()
+		jsonl = reader
+	}
+
+	results := startBatch(ctx, jsonl, batchConcurrency, func(ctx context.Context, reqData IngestRequest) (FileStatus, error) {
+		return startJob(ctx, client, storageClient, reqData)
+	})
+
+	log.Printf("Started batch of %d lines", len(results))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
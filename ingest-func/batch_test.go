@@ -0,0 +1,50 @@
+package stt
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_startBatch(t *testing.T) {
+	jsonl := `{"file": "gs://b/a.wav", "lang": "no-NO"}
+
+not json
+{"file": "gs://b/b.wav", "lang": "no-NO"}
+{"file": "gs://b/c.wav", "lang": "no-NO"}
+`
+	running := 0
+	maxRunning := 0
+	mutex := sync.Mutex{}
+	start := func(ctx context.Context, r IngestRequest) (FileStatus, error) {
+		mutex.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mutex.Unlock()
+		defer func() {
+			mutex.Lock()
+			running--
+			mutex.Unlock()
+		}()
+
+		if strings.HasSuffix(r.File, "b.wav") {
+			return FileStatus{}, fmt.Errorf("File is already in progress")
+		}
+		return FileStatus{JobID: "job-" + r.File[7:8], IngestRequest: r, Status: StatusProcessing}, nil
+	}
+
+	results := startBatch(context.Background(), strings.NewReader(jsonl), 2, start)
+	assert.Len(t, results, 4)
+	assert.Equal(t, BatchResult{Line: 1, File: "gs://b/a.wav", JobID: "job-a", Status: StatusProcessing}, results[0])
+	assert.Equal(t, 3, results[1].Line)
+	assert.True(t, strings.HasPrefix(results[1].Error, "Error parsing request"))
+	assert.Equal(t, BatchResult{Line: 4, File: "gs://b/b.wav", Error: "File is already in progress"}, results[2])
+	assert.Equal(t, "job-c", results[3].JobID)
+	assert.True(t, maxRunning <= 2)
+}
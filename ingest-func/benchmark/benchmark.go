@@ -0,0 +1,225 @@
+// Package benchmark measures the word error rate of a recognition configuration over a reference corpus
+package benchmark
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+
+	"go.bcc.media/stt"
+	"go.bcc.media/stt/wer"
+)
+
+// Entry is an audio file of the corpus with the path of its reference transcript.
+// The audio must be in a format the recognizer reads, it is not transcoded.
+type Entry struct {
+	stt.IngestRequest
+	Reference string `json:"reference"`
+}
+
+// ReadManifest reads a JSON list of entries. Relative reference paths are relative to the manifest.
+func ReadManifest(path string) ([]Entry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []Entry{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("%s is not a valid manifest: %v", path, err)
+	}
+
+	for i, e := range entries {
+		if e.Reference != "" && !filepath.IsAbs(e.Reference) {
+			entries[i].Reference = filepath.Join(filepath.Dir(path), e.Reference)
+		}
+	}
+
+	return entries, nil
+}
+
+// Config holds the recognition settings that are applied to every entry,
+// in the same JSON format as the Ingest request. Vocabularies are not loaded, use phrases instead.
+type Config struct {
+	Name     string
+	Settings json.RawMessage
+}
+
+// ReadConfig reads a configuration file, named after the file
+func ReadConfig(path string) (Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+
+	return Config{Name: filepath.Base(path), Settings: data}, nil
+}
+
+// apply returns the request of the entry with the settings of the configuration
+func (c Config) apply(e Entry) (stt.IngestRequest, error) {
+	req := e.IngestRequest
+	if len(c.Settings) > 0 {
+		if err := json.Unmarshal(c.Settings, &req); err != nil {
+			return req, fmt.Errorf("Invalid configuration %s: %v", c.Name, err)
+		}
+	}
+
+	// The configuration can not change the audio
+	req.File = e.File
+	if req.Channels == 0 {
+		// Same default as Ingest
+		req.Channels = 2
+	}
+
+	return req, req.Validate()
+}
+
+// FileResult is the score of one entry
+type FileResult struct {
+	File     string   `json:"file"`
+	Language string   `json:"lang"`
+	Info     wer.Info `json:"info"`
+	WER      float64  `json:"wer"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// Report is the result of running the corpus with one configuration
+type Report struct {
+	Config    string              `json:"config"`
+	Files     []FileResult        `json:"files"`
+	Languages map[string]wer.Info `json:"languages"`
+	Total     wer.Info            `json:"total"`
+}
+
+// Run recognizes every entry with the configuration and scores it against the reference.
+// Entries that fail are reported with the error and left out of the totals.
+func Run(ctx context.Context, recognizer stt.Recognizer, entries []Entry, config Config) Report {
+	report := Report{
+		Config:    config.Name,
+		Files:     []FileResult{},
+		Languages: map[string]wer.Info{},
+	}
+
+	for _, e := range entries {
+		result := FileResult{File: e.File, Language: e.Language}
+		info, err := score(ctx, recognizer, e, config)
+		if err != nil {
+			result.Error = err.Error()
+			report.Files = append(report.Files, result)
+			continue
+		}
+
+		result.Info = info
+		result.WER = info.WER()
+		report.Files = append(report.Files, result)
+		report.Languages[e.Language] = report.Languages[e.Language].Add(info)
+		report.Total = report.Total.Add(info)
+	}
+
+	return report
+}
+
+func score(ctx context.Context, recognizer stt.Recognizer, e Entry, config Config) (wer.Info, error) {
+	req, err := config.apply(e)
+	if err != nil {
+		return wer.Info{}, err
+	}
+
+	reference, err := ioutil.ReadFile(e.Reference)
+	if err != nil {
+		return wer.Info{}, err
+	}
+
+	transcript, err := recognizer.Recognize(ctx, req)
+	if err != nil {
+		return wer.Info{}, err
+	}
+
+	evaluator := wer.New(nil)
+	evaluator.HTMLHandler = nil
+	return evaluator.AddHypRef(transcript.Text(), string(reference))
+}
+
+func formatWER(info wer.Info) string {
+	if info.Words == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.2f%%", info.WER())
+}
+
+func formatDelta(a, b wer.Info) string {
+	if a.Words == 0 || b.Words == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%+.2f", b.WER()-a.WER())
+}
+
+// languages returns the languages of the reports, sorted
+func languages(reports ...Report) []string {
+	seen := map[string]bool{}
+	list := []string{}
+	for _, r := range reports {
+		for lang := range r.Languages {
+			if !seen[lang] {
+				seen[lang] = true
+				list = append(list, lang)
+			}
+		}
+	}
+
+	sort.Strings(list)
+	return list
+}
+
+// WriteReport writes the WER of a report as Markdown tables
+func WriteReport(w io.Writer, r Report) error {
+	fmt.Fprintf(w, "# %s\n\n| | WER |\n|---|---:|\n", r.Config)
+	fmt.Fprintf(w, "| **Total** | %s |\n", formatWER(r.Total))
+	for _, lang := range languages(r) {
+		fmt.Fprintf(w, "| %s | %s |\n", lang, formatWER(r.Languages[lang]))
+	}
+
+	fmt.Fprintf(w, "\n| File | WER | Error |\n|---|---:|---|\n")
+	for _, f := range r.Files {
+		fmt.Fprintf(w, "| %s | %s | %s |\n", f.File, fileWER(f), f.Error)
+	}
+
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+// WriteComparison writes a Markdown table comparing the WER of two reports of the same corpus.
+// A negative change means that b is better.
+func WriteComparison(w io.Writer, a, b Report) error {
+	fmt.Fprintf(w, "# %s vs %s\n\n", a.Config, b.Config)
+	fmt.Fprintf(w, "| | %s | %s | Change |\n|---|---:|---:|---:|\n", a.Config, b.Config)
+	fmt.Fprintf(w, "| **Total** | %s | %s | %s |\n", formatWER(a.Total), formatWER(b.Total), formatDelta(a.Total, b.Total))
+
+	for _, lang := range languages(a, b) {
+		fmt.Fprintf(w, "| %s | %s | %s | %s |\n", lang, formatWER(a.Languages[lang]), formatWER(b.Languages[lang]), formatDelta(a.Languages[lang], b.Languages[lang]))
+	}
+
+	fmt.Fprintf(w, "\n| File | %s | %s | Change |\n|---|---:|---:|---:|\n", a.Config, b.Config)
+	for i, fa := range a.Files {
+		fb := FileResult{}
+		if i < len(b.Files) {
+			fb = b.Files[i]
+		}
+
+		fmt.Fprintf(w, "| %s | %s | %s | %s |\n", fa.File, fileWER(fa), fileWER(fb), formatDelta(fa.Info, fb.Info))
+	}
+
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+func fileWER(f FileResult) string {
+	if f.Error != "" {
+		return "error"
+	}
+	return formatWER(f.Info)
+}
@@ -0,0 +1,68 @@
+package benchmark
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.bcc.media/stt"
+)
+
+// fakeRecognizer returns the text configured for the model of the request
+type fakeRecognizer map[string]string
+
+func (f fakeRecognizer) Recognize(ctx context.Context, audio stt.IngestRequest) (stt.Transcript, error) {
+	return stt.Transcript{
+		Language: audio.Language,
+		Segments: []stt.Segment{{Text: f[audio.Model], Language: audio.Language}},
+	}, nil
+}
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func Test_Run(t *testing.T) {
+	dir, err := ioutil.TempDir("", "benchmark")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	writeFile(t, dir, "a.txt", "God morgen alle sammen")
+	manifest := writeFile(t, dir, "manifest.json", `[
+		{"file": "gs://corpus/a.flac", "lang": "no-NO", "reference": "a.txt"},
+		{"file": "gs://corpus/b.flac", "lang": "no-NO", "reference": "missing.txt"}
+	]`)
+
+	entries, err := ReadManifest(manifest)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+
+	recognizer := fakeRecognizer{"default": "god morgen alle", "video": "god morgen alle sammen"}
+	recordings := filepath.Join(dir, "recordings")
+	a := Run(context.Background(), stt.RecordingRecognizer{Recognizer: recognizer, Dir: recordings}, entries, Config{Name: "default", Settings: []byte(`{"model": "default"}`)})
+	b := Run(context.Background(), stt.RecordingRecognizer{Recognizer: recognizer, Dir: recordings}, entries, Config{Name: "video", Settings: []byte(`{"model": "video"}`)})
+
+	assert.Equal(t, 25.0, a.Files[0].WER)
+	assert.NotEmpty(t, a.Files[1].Error)
+	assert.Equal(t, 4, a.Languages["no-NO"].Words)
+	assert.Equal(t, 0.0, b.Total.WER())
+
+	// The recorded transcripts give the same results offline
+	replayed := Run(context.Background(), stt.ReplayRecognizer{Dir: recordings}, entries[:1], Config{Name: "default", Settings: []byte(`{"model": "default"}`)})
+	assert.Equal(t, a.Files[0], replayed.Files[0])
+
+	_, err = stt.ReplayRecognizer{Dir: recordings}.Recognize(context.Background(), stt.IngestRequest{File: "gs://corpus/c.flac"})
+	assert.NotNil(t, err)
+
+	out := bytes.Buffer{}
+	assert.Nil(t, WriteComparison(&out, a, b))
+	assert.True(t, strings.Contains(out.String(), "| **Total** | 25.00% | 0.00% | -25.00 |"))
+	assert.True(t, strings.Contains(out.String(), "| gs://corpus/b.flac | error | error | - |"))
+}
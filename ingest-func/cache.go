@@ -0,0 +1,97 @@
+package stt
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+
+	"cloud.google.com/go/storage"
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1p1beta1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// cachePrefix is where the recognition results are cached in the result bucket
+const cachePrefix = "cache/"
+
+// contentHash identifies the content of an object independent of its name.
+// Composite objects have no MD5, so the CRC32C and size are used for them.
+func contentHash(attrs *storage.ObjectAttrs) string {
+	if len(attrs.MD5) > 0 {
+		return "md5:" + hex.EncodeToString(attrs.MD5)
+	}
+	return fmt.Sprintf("crc32c:%08x:%d", attrs.CRC32C, attrs.Size)
+}
+
+// cacheKey is the same for files with the same content that are recognized with the same settings
+func cacheKey(content string, audio IngestRequest) (string, error) {
+	config, err := proto.MarshalOptions{Deterministic: true}.Marshal(recognitionConfig(audio))
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%t\n%d\n", content, audio.NeedsTranscode(), audio.ChunkMinutes)
+	h.Write(config)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func cacheObject(resultBucket *storage.BucketHandle, key string) *storage.ObjectHandle {
+	return resultBucket.Object(fmt.Sprintf("%s%s.json", cachePrefix, key))
+}
+
+// lookupCache returns the cache key of the source with the settings of audio,
+// and the cached results if there are any
+func lookupCache(ctx context.Context, resultBucket *storage.BucketHandle, source *storage.ObjectHandle, audio IngestRequest) (string, []*speechpb.SpeechRecognitionResult, error) {
+	attrs, err := source.Attrs(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+
+	key, err := cacheKey(contentHash(attrs), audio)
+	if err != nil {
+		return "", nil, err
+	}
+
+	reader, err := cacheObject(resultBucket, key).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return key, nil, nil
+	} else if err != nil {
+		return key, nil, err
+	}
+	defer reader.Close()
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return key, nil, err
+	}
+
+	response := &speechpb.LongRunningRecognizeResponse{}
+	if err := protojson.Unmarshal(data, response); err != nil {
+		return key, nil, fmt.Errorf("Invalid cache entry %s: %v", key, err)
+	}
+
+	if response.Results == nil {
+		// Audio without speech is cached too
+		response.Results = []*speechpb.SpeechRecognitionResult{}
+	}
+	return key, response.Results, nil
+}
+
+// writeCache stores the results of a recognition under its cache key
+func writeCache(ctx context.Context, resultBucket *storage.BucketHandle, key string, results []*speechpb.SpeechRecognitionResult) error {
+	data, err := protojson.Marshal(&speechpb.LongRunningRecognizeResponse{Results: results})
+	if err != nil {
+		return err
+	}
+
+	writer := cacheObject(resultBucket, key).NewWriter(ctx)
+	writer.ContentType = "application/json"
+	if _, err := writer.Write(data); err != nil {
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
@@ -0,0 +1,48 @@
+package stt
+
+import (
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_contentHash(t *testing.T) {
+	assert.Equal(t, "md5:0102", contentHash(&storage.ObjectAttrs{MD5: []byte{1, 2}, CRC32C: 5, Size: 10}))
+	assert.Equal(t, "crc32c:0000000f:10", contentHash(&storage.ObjectAttrs{CRC32C: 15, Size: 10}))
+}
+
+func Test_cacheKey(t *testing.T) {
+	a := IngestRequest{File: "gs://bucket/a.wav", Language: "no-NO", Channels: 2}
+	b := a
+	b.File = "gs://other/renamed.wav"
+
+	keyA, err := cacheKey("md5:0102", a)
+	assert.Nil(t, err)
+	keyB, err := cacheKey("md5:0102", b)
+	assert.Nil(t, err)
+	assert.Equal(t, keyA, keyB, "the name of the file is not part of the key")
+
+	other, _ := cacheKey("md5:0103", a)
+	assert.NotEqual(t, keyA, other)
+
+	b.Language = "en-US"
+	other, _ = cacheKey("md5:0102", b)
+	assert.NotEqual(t, keyA, other)
+
+	b = a
+	b.Phrases = []PhraseSet{{Phrases: []string{"Brunstad"}, Boost: 10}}
+	other, _ = cacheKey("md5:0102", b)
+	assert.NotEqual(t, keyA, other)
+
+	b = a
+	b.ChunkMinutes = 10
+	other, _ = cacheKey("md5:0102", b)
+	assert.NotEqual(t, keyA, other)
+
+	// The script only changes the outputs, which are made from the cached results
+	b = a
+	b.Script = "Hello"
+	other, _ = cacheKey("md5:0102", b)
+	assert.Equal(t, keyA, other)
+}
@@ -0,0 +1,138 @@
+package stt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	speech "cloud.google.com/go/speech/apiv1p1beta1"
+	"cloud.google.com/go/storage"
+	longrunningpb "google.golang.org/genproto/googleapis/longrunning"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// CancelRequest is the body of the Cancel endpoint
+type CancelRequest struct {
+	File    string `json:"file"`
+	User    string `json:"user"`
+	Comment string `json:"comment,omitempty"`
+
+	// DeleteSource removes the source file and the transcoded audio and chunks
+	DeleteSource bool `json:"delete_source,omitempty"`
+}
+
+// operationNames returns the names of the speech operations of a job
+func (s FileStatus) operationNames() []string {
+	names := []string{}
+	if s.JobID != "" {
+		names = append(names, s.JobID)
+	}
+	for _, c := range s.Chunks {
+		if c.JobID != "" {
+			names = append(names, c.JobID)
+		}
+	}
+	return names
+}
+
+// starting is true for a job that startJob is still preparing, it is processing without operations.
+// Its source may be read by a transcode or split that is running.
+func (s FileStatus) starting() bool {
+	return s.Status == StatusProcessing && len(s.operationNames()) == 0
+}
+
+// cancelOperations asks the speech API to stop the operations of a job.
+// Operations that are finished or gone already are not an error.
+func cancelOperations(ctx context.Context, client *speech.Client, names []string) error {
+	for _, name := range names {
+		err := client.LROClient.CancelOperation(ctx, &longrunningpb.CancelOperationRequest{Name: name})
+		switch status.Code(err) {
+		case codes.OK, codes.NotFound, codes.FailedPrecondition:
+		case codes.Unimplemented:
+			// The results of the operation are ignored instead
+			log.Printf("Operation %s can not be cancelled: %v", name, err)
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Cancel stops a queued or processing job. The job is marked as cancelled first,
+// so the results of operations that can not be stopped are ignored.
+func Cancel(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.URL.Query().Get("key") != apiKey {
+		sendError(w, "Wrong key", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		sendError(w, "Only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	reqData := CancelRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		sendError(w, "Error parsing request", http.StatusBadRequest)
+		return
+	}
+
+	if reqData.User == "" {
+		sendError(w, "Field user is required", http.StatusBadRequest)
+		return
+	}
+
+	storageClient, err := storage.NewClient(ctx)
+	if err != nil {
+		sendError(w, fmt.Sprintf("Unable to create a storage client: %+v", err), http.StatusInternalServerError)
+		return
+	}
+
+	statusFile, fileStatus, ok := fileStatusFromRequest(w, r, storageClient, reqData.File)
+	if !ok {
+		return
+	}
+
+	starting := fileStatus.starting()
+	if err := fileStatus.setStatus(StatusCancelled, reqData.User, reqData.Comment); err != nil {
+		sendError(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	generation, err := writeStatusGeneration(ctx, statusFile, fileStatus)
+	if isConflict(err) {
+		sendError(w, "Status was changed by someone else, try again", http.StatusConflict)
+		return
+	} else if err != nil {
+		sendError(w, fmt.Sprintf("Unable to write status file: %+v", err), http.StatusInternalServerError)
+		return
+	}
+
+	client, err := speech.NewClient(ctx)
+	if err != nil {
+		log.Printf("Can't connect to speech API, operations of %s are not cancelled: %+v", fileStatus.SourceFile, err)
+	} else if err := cancelOperations(ctx, client, fileStatus.operationNames()); err != nil {
+		log.Printf("Error cancelling operations of %s: %+v", fileStatus.SourceFile, err)
+	}
+
+	bucket := storageClient.Bucket(statusFile.BucketName())
+	if reqData.DeleteSource && starting {
+		// startJob removes what it made when it sees the cancelled status
+		log.Printf("%s is still being started, its source is not deleted", fileStatus.SourceFile)
+	} else if reqData.DeleteSource {
+		deleteSourceFiles(ctx, bucket, fileStatus)
+	}
+
+	if err := renameStatus(ctx, bucket, bucket.Object(statusFile.ObjectName()).If(storage.Conditions{GenerationMatch: generation}), "done"); err != nil {
+		log.Printf("Error moving status of %s: %+v", fileStatus.SourceFile, err)
+	}
+
+	log.Printf("%s: cancelled by %s", fileStatus.SourceFile, reqData.User)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fileStatus)
+}
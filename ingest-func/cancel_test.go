@@ -0,0 +1,133 @@
+package stt
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	longrunningpb "google.golang.org/genproto/googleapis/longrunning"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+)
+
+func Test_operationNames(t *testing.T) {
+	assert.Equal(t, []string{"op1"}, FileStatus{JobID: "op1"}.operationNames())
+	assert.Equal(t, []string{"a", "b"}, FileStatus{Chunks: []Chunk{{JobID: "a"}, {JobID: "b"}, {}}}.operationNames())
+	assert.Equal(t, []string{}, FileStatus{}.operationNames())
+}
+
+func Test_cancelStatus(t *testing.T) {
+	s := FileStatus{Status: StatusProcessing}
+	assert.Nil(t, s.setStatus(StatusCancelled, "editor", "wrong file"))
+	assert.Equal(t, StatusCancelled, s.Status)
+	assert.Equal(t, "editor", s.History[0].By)
+
+	s = FileStatus{Status: StatusQueued}
+	assert.Nil(t, s.setStatus(StatusCancelled, "editor", ""))
+
+	// Finished jobs can not be cancelled
+	s = FileStatus{Status: StatusTranscribed}
+	assert.NotNil(t, s.setStatus(StatusCancelled, "editor", ""))
+	s = FileStatus{Status: StatusCancelled}
+	assert.NotNil(t, s.setStatus(StatusCancelled, "editor", ""))
+}
+
+func Test_starting(t *testing.T) {
+	assert.True(t, FileStatus{Status: StatusProcessing}.starting())
+	assert.True(t, FileStatus{Status: StatusProcessing, Chunks: []Chunk{{File: "chunks/a/000.flac"}}}.starting())
+	assert.False(t, FileStatus{Status: StatusProcessing, JobID: "op1"}.starting())
+	assert.False(t, FileStatus{Status: StatusQueued}.starting())
+}
+
+// cancelInFake does what Cancel does to the status of a job
+func cancelInFake(t *testing.T, fake *fakeStorage, name string) {
+	s := fake.getStatus(t, "ingest", name)
+	assert.NoError(t, s.setStatus(StatusCancelled, "editor", ""))
+	fake.putStatus(t, "ingest", name+".done", s)
+
+	fake.mu.Lock()
+	delete(fake.objects, "ingest/"+name)
+	fake.mu.Unlock()
+}
+
+func useTestBuckets() func() {
+	ingest, result := ingestBucketID, resultBucketID
+	ingestBucketID, resultBucketID = "ingest", "result"
+	return func() { ingestBucketID, resultBucketID = ingest, result }
+}
+
+func Test_resultWorker_cancelledWhileCompleting(t *testing.T) {
+	defer useTestBuckets()()
+	storageClient, fakeStorage := newFakeStorage(t)
+	client, fakeSpeech, stop := newFakeSpeech(t)
+	defer stop()
+
+	s := FileStatus{IngestRequest: IngestRequest{File: "gs://ingest/a.flac", Language: "no-NO", FPS: DefaultFPS}, SourceFile: "a.flac", JobID: "op1"}
+	assert.NoError(t, s.setStatus(StatusProcessing, systemUser, ""))
+	fakeStorage.putStatus(t, "ingest", "status/a.flac.json", s)
+	fakeStorage.put("ingest", "a.flac", []byte("audio"), nil)
+
+	fakeSpeech.setOperation(doneOperation(t, "op1", testResult("", 0, "God", "morgen")))
+	fakeSpeech.onGet = func() { cancelInFake(t, fakeStorage, "status/a.flac.json") }
+
+	ingest := storageClient.Bucket("ingest")
+	attrs, err := ingest.Object("status/a.flac.json").Attrs(context.Background())
+	assert.NoError(t, err)
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	resultWorker(context.Background(), &wg, client, ingest, storageClient.Bucket("result"), attrs)
+
+	// The job stays cancelled and its source is kept
+	assert.Nil(t, fakeStorage.get("ingest", "status/a.flac.json"))
+	assert.Equal(t, StatusCancelled, fakeStorage.getStatus(t, "ingest", "status/a.flac.json.done").Status)
+	assert.NotNil(t, fakeStorage.get("ingest", "a.flac"))
+}
+
+func Test_resultWorker_cancelledWhileRetrying(t *testing.T) {
+	defer useTestBuckets()()
+	storageClient, fakeStorage := newFakeStorage(t)
+	client, fakeSpeech, stop := newFakeSpeech(t)
+	defer stop()
+
+	s := FileStatus{IngestRequest: IngestRequest{File: "gs://ingest/a.flac", Language: "no-NO", FPS: DefaultFPS}, SourceFile: "a.flac", JobID: "failed"}
+	assert.NoError(t, s.setStatus(StatusProcessing, systemUser, ""))
+	fakeStorage.putStatus(t, "ingest", "status/a.flac.json", s)
+
+	fakeSpeech.setOperation(&longrunningpb.Operation{Name: "failed", Done: true, Result: &longrunningpb.Operation_Error{
+		Error: &rpcstatus.Status{Code: int32(codes.Unavailable), Message: "try again"},
+	}})
+	fakeSpeech.onStart = func() { cancelInFake(t, fakeStorage, "status/a.flac.json") }
+
+	ingest := storageClient.Bucket("ingest")
+	attrs, err := ingest.Object("status/a.flac.json").Attrs(context.Background())
+	assert.NoError(t, err)
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	resultWorker(context.Background(), &wg, client, ingest, storageClient.Bucket("result"), attrs)
+
+	// The operation of the retry is not in any status, so it is stopped
+	assert.Equal(t, []string{"op1"}, fakeSpeech.cancelled)
+	assert.Nil(t, fakeStorage.get("ingest", "status/a.flac.json"))
+	assert.Equal(t, StatusCancelled, fakeStorage.getStatus(t, "ingest", "status/a.flac.json.done").Status)
+}
+
+func Test_startJob_cancelledWhileStarting(t *testing.T) {
+	defer useTestBuckets()()
+	storageClient, fakeStorage := newFakeStorage(t)
+	client, fakeSpeech, stop := newFakeSpeech(t)
+	defer stop()
+
+	fakeStorage.put("ingest", "a.flac", []byte("audio"), nil)
+	fakeSpeech.onStart = func() { cancelInFake(t, fakeStorage, "status/a.flac.json") }
+
+	_, err := startJob(context.Background(), client, storageClient, IngestRequest{File: "gs://ingest/a.flac", Language: "no-NO", NoCache: true})
+	assert.Equal(t, http.StatusConflict, errorStatusCode(err))
+
+	assert.Equal(t, []string{"op1"}, fakeSpeech.cancelled)
+	assert.Nil(t, fakeStorage.get("ingest", "status/a.flac.json"))
+	assert.Equal(t, StatusCancelled, fakeStorage.getStatus(t, "ingest", "status/a.flac.json.done").Status)
+}
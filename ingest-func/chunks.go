@@ -0,0 +1,214 @@
+package stt
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"time"
+
+	speech "cloud.google.com/go/speech/apiv1p1beta1"
+	"cloud.google.com/go/storage"
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1p1beta1"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// chunksPrefix is where the split audio files are stored in the ingest bucket
+const chunksPrefix = "chunks/"
+
+// Parameters of the ffmpeg silencedetect filter used to find split points
+const (
+	silenceNoise    = "-30dB"
+	silenceDuration = 0.5
+)
+
+var (
+	silenceRegexp  = regexp.MustCompile(`silence_(start|end): (-?[0-9.]+)`)
+	durationRegexp = regexp.MustCompile(`Duration: (\d+):(\d+):(\d+(?:\.\d+)?)`)
+)
+
+// Chunk is one part of a split audio file that is recognized as a separate job
+type Chunk struct {
+	File  string `json:"file"`
+	JobID string `json:"job_id"`
+	// Offset of the chunk in the source file, in seconds
+	Offset float64 `json:"offset"`
+}
+
+func (c Chunk) offset() time.Duration {
+	return time.Duration(c.Offset * float64(time.Second))
+}
+
+type silence struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+func parseSeconds(s string) time.Duration {
+	f, _ := strconv.ParseFloat(s, 64)
+	return time.Duration(f * float64(time.Second))
+}
+
+// parseSilences extracts the detected silences and the total duration from the output of silencedetect
+func parseSilences(output string) ([]silence, time.Duration) {
+	var total time.Duration
+	if m := durationRegexp.FindStringSubmatch(output); m != nil {
+		h, _ := strconv.Atoi(m[1])
+		mins, _ := strconv.Atoi(m[2])
+		total = time.Duration(h)*time.Hour + time.Duration(mins)*time.Minute + parseSeconds(m[3])
+	}
+
+	silences := []silence{}
+	var start *time.Duration
+	for _, m := range silenceRegexp.FindAllStringSubmatch(output, -1) {
+		t := parseSeconds(m[2])
+		if m[1] == "start" {
+			start = &t
+			continue
+		}
+
+		if start != nil {
+			silences = append(silences, silence{Start: *start, End: t})
+			start = nil
+		}
+	}
+
+	return silences, total
+}
+
+// splitPoints returns the start of each chunk.
+//
+// Chunks are cut in the middle of the last silence before they reach chunkLen,
+// but never shorter than half of chunkLen. If there is no such silence the audio is cut hard.
+func splitPoints(silences []silence, total, chunkLen time.Duration) []time.Duration {
+	points := []time.Duration{0}
+	start := time.Duration(0)
+
+	for total-start > chunkLen {
+		cut := start + chunkLen
+		for _, s := range silences {
+			mid := (s.Start + s.End) / 2
+			if mid > start+chunkLen/2 && mid <= start+chunkLen {
+				cut = mid
+			}
+		}
+
+		points = append(points, cut)
+		start = cut
+	}
+
+	return points
+}
+
+// splitAudio cuts src into mono FLAC chunks of approximately chunkLen and stores them in the ingest bucket.
+// The source is read from the bucket and every chunk is streamed into its object as it is cut.
+func splitAudio(ctx context.Context, src *storage.ObjectHandle, ingestBucket *storage.BucketHandle, chunkLen time.Duration) ([]Chunk, error) {
+	uri, options, err := storageInput(ctx, src)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %v", src.ObjectName(), err)
+	}
+
+	out, err := runFFmpeg(ctx, append(options,
+		"-nostdin", "-i", uri, "-vn",
+		"-af", fmt.Sprintf("silencedetect=noise=%s:d=%.1f", silenceNoise, silenceDuration),
+		"-f", "null", "-",
+	)...)
+	if err != nil {
+		return nil, err
+	}
+
+	silences, total := parseSilences(out)
+	if total == 0 {
+		return nil, fmt.Errorf("unable to determine the duration of %s", src.ObjectName())
+	}
+
+	points := splitPoints(silences, total, chunkLen)
+	chunks := []Chunk{}
+	for i, start := range points {
+		length := time.Duration(0)
+		if i+1 < len(points) {
+			length = points[i+1] - start
+		}
+
+		dst := ingestBucket.Object(fmt.Sprintf("%s%s/%03d.flac", chunksPrefix, src.ObjectName(), i))
+		if err := ffmpegToObject(ctx, dst, append(options, ffmpegArgs(uri, "pipe:1", start, length)...)...); err != nil {
+			deleteChunks(ctx, ingestBucket, chunks)
+			return nil, err
+		}
+
+		chunks = append(chunks, Chunk{File: dst.ObjectName(), Offset: start.Seconds()})
+	}
+
+	log.Printf("Split %s into %d chunks", src.ObjectName(), len(chunks))
+	return chunks, nil
+}
+
+// deleteChunks removes the audio files of chunks from the ingest bucket
+func deleteChunks(ctx context.Context, ingestBucket *storage.BucketHandle, chunks []Chunk) {
+	for _, c := range chunks {
+		_ = ingestBucket.Object(c.File).Delete(ctx)
+	}
+}
+
+// startChunks submits every chunk that is not started yet as its own recognition job
+func startChunks(ctx context.Context, client *speech.Client, reqData IngestRequest, chunks []Chunk) error {
+	for i := range chunks {
+		if chunks[i].JobID != "" {
+			// Started before the job was queued
+			continue
+		}
+
+		audio := reqData.transcodedRequest(fmt.Sprintf("gs://%s/%s", ingestBucketID, chunks[i].File))
+
+		jobID, err := startRecognition(ctx, client, audio)
+		if err != nil {
+			return err
+		}
+
+		chunks[i].JobID = jobID
+	}
+
+	return nil
+}
+
+// pollChunks returns the stitched results once all chunks are done, and the combined progress of the chunks
+func pollChunks(ctx context.Context, client *speech.Client, chunks []Chunk) ([]*speechpb.SpeechRecognitionResult, bool, *Progress, error) {
+	results := []*speechpb.SpeechRecognitionResult{}
+	progress := []*Progress{}
+	done := true
+	for _, c := range chunks {
+		chunkResults, chunkDone, chunkProgress, err := pollResults(ctx, client, c.JobID)
+		if err != nil {
+			return nil, chunkDone, nil, err
+		}
+
+		progress = append(progress, chunkProgress)
+		if !chunkDone {
+			done = false
+			continue
+		}
+
+		results = append(results, shiftResults(chunkResults, c.offset())...)
+	}
+
+	if !done {
+		return nil, false, combineProgress(progress), nil
+	}
+
+	return results, true, combineProgress(progress), nil
+}
+
+// shiftResults moves the word offsets of a chunk so they are relative to the start of the source file
+func shiftResults(results []*speechpb.SpeechRecognitionResult, offset time.Duration) []*speechpb.SpeechRecognitionResult {
+	for _, r := range results {
+		for _, alt := range r.Alternatives {
+			for _, w := range alt.Words {
+				w.StartTime = durationpb.New(w.StartTime.AsDuration() + offset)
+				w.EndTime = durationpb.New(w.EndTime.AsDuration() + offset)
+			}
+		}
+	}
+
+	return results
+}
@@ -0,0 +1,51 @@
+package stt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1p1beta1"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+const silenceDetectOutput = `Input #0, wav, from 'source.wav':
+  Duration: 00:25:00.50, bitrate: 256 kb/s
+[silencedetect @ 0x55d5] silence_start: 290
+[silencedetect @ 0x55d5] silence_end: 292 | silence_duration: 2
+[silencedetect @ 0x55d5] silence_start: 598
+[silencedetect @ 0x55d5] silence_end: 599 | silence_duration: 1
+[silencedetect @ 0x55d5] silence_start: 1499`
+
+func Test_parseSilences(t *testing.T) {
+	silences, total := parseSilences(silenceDetectOutput)
+	assert.Equal(t, 25*time.Minute+500*time.Millisecond, total)
+	assert.Equal(t, []silence{
+		{Start: 290 * time.Second, End: 292 * time.Second},
+		{Start: 598 * time.Second, End: 599 * time.Second},
+	}, silences)
+}
+
+func Test_splitPoints(t *testing.T) {
+	silences, total := parseSilences(silenceDetectOutput)
+
+	// Cut at the last silence before 10 minutes, hard cut when there is none
+	assert.Equal(t, []time.Duration{0, 598500 * time.Millisecond, 1198500 * time.Millisecond}, splitPoints(silences, total, 10*time.Minute))
+	assert.Equal(t, []time.Duration{0, 291 * time.Second, 591 * time.Second, 891 * time.Second, 1191 * time.Second, 1491 * time.Second}, splitPoints(silences, total, 5*time.Minute))
+
+	// Short files are not split
+	assert.Equal(t, []time.Duration{0}, splitPoints(silences, total, time.Hour))
+}
+
+func Test_shiftResults(t *testing.T) {
+	results := []*speechpb.SpeechRecognitionResult{{
+		Alternatives: []*speechpb.SpeechRecognitionAlternative{{
+			Words: []*speechpb.WordInfo{{Word: "hei", StartTime: durationpb.New(time.Second), EndTime: durationpb.New(2 * time.Second)}},
+		}},
+	}}
+
+	shiftResults(results, 10*time.Minute)
+	w := results[0].Alternatives[0].Words[0]
+	assert.Equal(t, 10*time.Minute+time.Second, w.StartTime.AsDuration())
+	assert.Equal(t, 10*time.Minute+2*time.Second, w.EndTime.AsDuration())
+}
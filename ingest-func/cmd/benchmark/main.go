@@ -0,0 +1,128 @@
+// Command benchmark measures the word error rate of recognition configurations over a reference corpus.
+//
+// Usage:
+//
+//	benchmark -manifest corpus.json [-mode live|record|replay] [-recordings dir] [-out report.md] config.json [other.json]
+//
+// The manifest is a JSON list of Ingest requests with the path of a reference transcript in "reference",
+// and a configuration is a JSON file with the request fields to apply to every entry, like
+// {"preset": "interview", "phrases": [{"phrases": ["Brunstad"], "boost": 10}]}.
+// With two configurations the report compares them, otherwise it lists the WER of the one.
+//
+// In record mode the transcripts are stored in the recordings directory,
+// and replay mode uses them instead of the speech API to run offline.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	speech "cloud.google.com/go/speech/apiv1p1beta1"
+	"go.bcc.media/stt"
+	"go.bcc.media/stt/benchmark"
+)
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+func recognizer(ctx context.Context, mode, dir string) (stt.Recognizer, error) {
+	if mode == "replay" {
+		return stt.ReplayRecognizer{Dir: dir}, nil
+	}
+
+	client, err := speech.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	switch mode {
+	case "live":
+		return stt.SpeechRecognizer{Client: client}, nil
+	case "record":
+		return stt.RecordingRecognizer{Recognizer: stt.SpeechRecognizer{Client: client}, Dir: dir}, nil
+	}
+
+	return nil, fmt.Errorf("Unknown mode: \"%s\"", mode)
+}
+
+func main() {
+	manifest := flag.String("manifest", "", "JSON list of audio files with reference transcripts")
+	mode := flag.String("mode", "live", "live, record or replay")
+	recordings := flag.String("recordings", "recordings", "directory of the recorded transcripts")
+	out := flag.String("out", "", "where to write the report, defaults to stdout")
+	jsonOut := flag.String("json", "", "where to write the reports as JSON")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] config.json [other.json]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *manifest == "" || flag.NArg() < 1 || flag.NArg() > 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	entries, err := benchmark.ReadManifest(*manifest)
+	if err != nil {
+		fail(err)
+	}
+
+	rec, err := recognizer(ctx, *mode, *recordings)
+	if err != nil {
+		fail(err)
+	}
+
+	reports := []benchmark.Report{}
+	for _, path := range flag.Args() {
+		config, err := benchmark.ReadConfig(path)
+		if err != nil {
+			fail(err)
+		}
+
+		report := benchmark.Run(ctx, rec, entries, config)
+		for _, f := range report.Files {
+			if f.Error != "" {
+				fmt.Fprintf(os.Stderr, "%s: %s: %s\n", config.Name, f.File, f.Error)
+			}
+		}
+		reports = append(reports, report)
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			fail(err)
+		}
+		defer file.Close()
+		w = file
+	}
+
+	if len(reports) == 2 {
+		err = benchmark.WriteComparison(w, reports[0], reports[1])
+	} else {
+		err = benchmark.WriteReport(w, reports[0])
+	}
+	if err != nil {
+		fail(err)
+	}
+
+	if *jsonOut != "" {
+		file, err := os.Create(*jsonOut)
+		if err != nil {
+			fail(err)
+		}
+		defer file.Close()
+
+		if err := json.NewEncoder(file).Encode(reports); err != nil {
+			fail(err)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// Command wer scores the transcript of a job against a reference transcript,
+// like utils/simple_wer_v2.py.
+//
+// Usage:
+//
+//	wer [-keyphrases file] [-html file] hypothesis reference
+//
+// The hypothesis is the JSON or text output of a job. The text output is read without
+// timestamps and low confidence brackets. Other files are read as plain text.
+// All files can be gs://bucket/object URLs, so the outputs of a job can be scored where
+// they were written: gs://<result bucket>/<source file>.json
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"go.bcc.media/stt"
+	"go.bcc.media/stt/wer"
+)
+
+var (
+	timestampRegexp     = regexp.MustCompile(`(?m)^\d{2}:\d{2}:\d{2}:\d{2}:`)
+	lowConfidenceRegexp = regexp.MustCompile(`\[([^\]\s]+)\]`)
+)
+
+// readFile reads a local file or a gs:// URL
+func readFile(ctx context.Context, name string) ([]byte, error) {
+	if !strings.HasPrefix(name, "gs://") {
+		return ioutil.ReadFile(name)
+	}
+
+	u, err := url.Parse(name)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	reader, err := client.Bucket(u.Host).Object(strings.TrimPrefix(u.Path, "/")).NewReader(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %v", name, err)
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+// readHypothesis returns the text of a job output
+func readHypothesis(ctx context.Context, name string) (string, error) {
+	data, err := readFile(ctx, name)
+	if err != nil {
+		return "", err
+	}
+
+	if strings.HasSuffix(name, ".json") {
+		transcript := stt.Transcript{}
+		if err := json.Unmarshal(data, &transcript); err != nil {
+			return "", fmt.Errorf("%s is not a JSON output: %v", name, err)
+		}
+		return transcript.Text(), nil
+	}
+
+	text := timestampRegexp.ReplaceAllString(string(data), "")
+	return lowConfidenceRegexp.ReplaceAllString(text, "$1"), nil
+}
+
+func readLines(ctx context.Context, name string) ([]string, error) {
+	data, err := readFile(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := []string{}
+	for _, l := range strings.Split(string(data), "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			lines = append(lines, l)
+		}
+	}
+	return lines, nil
+}
+
+func main() {
+	ctx := context.Background()
+	keyPhrasesFile := flag.String("keyphrases", "", "file with one key phrase per line")
+	htmlFile := flag.String("html", "", "where to write the diagnosis HTML, defaults to <hypothesis>_diagnosis.html")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] hypothesis reference\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	hypothesis, err := readHypothesis(ctx, flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	reference, err := readFile(ctx, flag.Arg(1))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var keyPhrases []string
+	if *keyPhrasesFile != "" {
+		keyPhrases, err = readLines(ctx, *keyPhrasesFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	evaluator := wer.New(keyPhrases)
+	if _, err := evaluator.AddHypRef(hypothesis, string(reference)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	summary, details, keyPhrasesInfo := evaluator.Summaries()
+	fmt.Println(summary)
+	fmt.Println(details)
+	fmt.Println(keyPhrasesInfo)
+
+	if *htmlFile == "" {
+		*htmlFile = flag.Arg(0) + "_diagnosis.html"
+		if strings.HasPrefix(flag.Arg(0), "gs://") {
+			// Written to the current directory
+			*htmlFile = path.Base(*htmlFile)
+		}
+	}
+
+	if err := ioutil.WriteFile(*htmlFile, []byte(evaluator.DiagnosisHTML()), 0644); err != nil {
+		fmt.Println("failed to write diagnosis html")
+	}
+}
@@ -0,0 +1,129 @@
+package stt
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1p1beta1"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	// lowConfidenceThreshold marks words recognized with a lower confidence
+	lowConfidenceThreshold = envFloat("LOW_CONFIDENCE_THRESHOLD", 0.5)
+
+	// reviewThreshold is the mean word confidence below which a job needs review,
+	// unless the request sets its own
+	reviewThreshold = envFloat("REVIEW_THRESHOLD", 0.6)
+)
+
+func envFloat(key string, fallback float32) float32 {
+	s := os.Getenv(key)
+	if s == "" {
+		return fallback
+	}
+
+	f, err := strconv.ParseFloat(s, 32)
+	if err != nil {
+		log.Printf("Invalid %s \"%s\", using %g: %+v", key, s, fallback, err)
+		return fallback
+	}
+
+	return float32(f)
+}
+
+// ConfidenceStats summarizes the word confidences of a job
+type ConfidenceStats struct {
+	Mean               float32 `json:"mean"`
+	Min                float32 `json:"min"`
+	Words              int     `json:"words"`
+	LowConfidenceWords int     `json:"low_confidence_words"`
+}
+
+// needsReview is true if the transcript is not good enough to be used as-is
+func (s ConfidenceStats) needsReview(threshold float32) bool {
+	return s.Words > 0 && s.Mean < threshold
+}
+
+// reviewThreshold returns the threshold for the job
+func (r IngestRequest) reviewThreshold() float32 {
+	if r.ReviewThreshold != nil {
+		return *r.ReviewThreshold
+	}
+	return reviewThreshold
+}
+
+func (r IngestRequest) validateReviewThreshold() error {
+	if r.ReviewThreshold != nil && (*r.ReviewThreshold < 0 || *r.ReviewThreshold > 1) {
+		return fmt.Errorf("Review threshold must be between 0 and 1")
+	}
+	return nil
+}
+
+// isLowConfidence is true for words with a known confidence below the threshold.
+// The recognizer reports 0 if the confidence is not available.
+func isLowConfidence(confidence float32) bool {
+	return confidence > 0 && confidence < lowConfidenceThreshold
+}
+
+// markLowConfidence flags the words with low confidence and returns the statistics
+func (t *Transcript) markLowConfidence() ConfidenceStats {
+	stats := ConfidenceStats{Min: 1}
+	sum := float32(0)
+
+	for i := range t.Segments {
+		for j := range t.Segments[i].Words {
+			w := &t.Segments[i].Words[j]
+			if w.Confidence == 0 {
+				continue
+			}
+
+			w.LowConfidence = isLowConfidence(w.Confidence)
+			if w.LowConfidence {
+				stats.LowConfidenceWords++
+			}
+
+			if w.Confidence < stats.Min {
+				stats.Min = w.Confidence
+			}
+
+			sum += w.Confidence
+			stats.Words++
+		}
+	}
+
+	if stats.Words == 0 {
+		return ConfidenceStats{}
+	}
+
+	stats.Mean = sum / float32(stats.Words)
+	return stats
+}
+
+// bracketLowConfidence returns a copy of the results where words with low confidence are in brackets
+func bracketLowConfidence(results []*speechpb.SpeechRecognitionResult) []*speechpb.SpeechRecognitionResult {
+	marked := []*speechpb.SpeechRecognitionResult{}
+	for _, r := range results {
+		r = proto.Clone(r).(*speechpb.SpeechRecognitionResult)
+		if len(r.Alternatives) > 0 {
+			for _, w := range r.Alternatives[0].Words {
+				if isLowConfidence(w.Confidence) {
+					w.Word = fmt.Sprintf("[%s]", w.Word)
+				}
+			}
+		}
+		marked = append(marked, r)
+	}
+
+	return marked
+}
+
+// completedStatus returns the status of a job whose outputs were written
+func completedStatus(fileStatus FileStatus) string {
+	if fileStatus.Confidence != nil && fileStatus.Confidence.needsReview(fileStatus.reviewThreshold()) {
+		return StatusNeedsReview
+	}
+	return StatusTranscribed
+}
@@ -0,0 +1,44 @@
+package stt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1p1beta1"
+)
+
+func Test_markLowConfidence(t *testing.T) {
+	result := testResult("", 0, "Velkommen", "til", "Brunstad")
+	for i, c := range []float32{0.9, 0.8, 0.1} {
+		result.Alternatives[0].Words[i].Confidence = c
+	}
+	results := []*speechpb.SpeechRecognitionResult{result}
+
+	transcript := transcriptFromResults(results, "no-NO")
+	stats := transcript.markLowConfidence()
+	assert.Equal(t, 3, stats.Words)
+	assert.Equal(t, 1, stats.LowConfidenceWords)
+	assert.Equal(t, float32(0.1), stats.Min)
+	assert.InDelta(t, 0.6, stats.Mean, 0.001)
+	assert.True(t, transcript.Segments[0].Words[2].LowConfidence)
+
+	assert.True(t, stats.needsReview(0.7))
+	assert.False(t, stats.needsReview(0.5))
+	threshold := float32(0.7)
+	assert.Equal(t, StatusNeedsReview, completedStatus(FileStatus{IngestRequest: IngestRequest{ReviewThreshold: &threshold}, Confidence: &stats}))
+
+	// A threshold of 0 turns review off
+	threshold = 0
+	assert.Equal(t, StatusTranscribed, completedStatus(FileStatus{IngestRequest: IngestRequest{ReviewThreshold: &threshold}, Confidence: &stats}))
+
+	assert.Equal(t, "Velkommen til [Brunstad]\n", transcriptionToPlainText(bracketLowConfidence(results), 25, false, defaultRules))
+	assert.Equal(t, "Brunstad", result.Alternatives[0].Words[2].Word)
+}
+
+func Test_markLowConfidence_unknown(t *testing.T) {
+	// Without word confidences there is nothing to review
+	transcript := transcriptFromResults([]*speechpb.SpeechRecognitionResult{testResult("", 0, "hei")}, "no-NO")
+	stats := transcript.markLowConfidence()
+	assert.Equal(t, ConfidenceStats{}, stats)
+	assert.False(t, stats.needsReview(0.9))
+}
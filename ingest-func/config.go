@@ -0,0 +1,181 @@
+package stt
+
+import (
+	"fmt"
+	"strings"
+
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1p1beta1"
+)
+
+// MaxAlternativeLanguages is the limit of the recognizer for alternative language codes
+const MaxAlternativeLanguages = 3
+
+// MaxAlternatives is the highest number of alternatives the recognizer returns per result
+const MaxAlternatives = 30
+
+// DefaultPreset is used when the request does not name a preset
+const DefaultPreset = "sermon"
+
+// models lists the recognition models that can be requested. Empty means the recognizer picks one
+var models = map[string]bool{
+	"":                   true,
+	"default":            true,
+	"video":              true,
+	"phone_call":         true,
+	"command_and_search": true,
+}
+
+// Preset holds recognition settings suited for a type of content
+type Preset struct {
+	Model              string
+	UseEnhanced        bool
+	InteractionType    speechpb.RecognitionMetadata_InteractionType
+	MicrophoneDistance speechpb.RecognitionMetadata_MicrophoneDistance
+	MediaType          speechpb.RecognitionMetadata_OriginalMediaType
+	DeviceType         speechpb.RecognitionMetadata_RecordingDeviceType
+}
+
+// presets by the name used in IngestRequest.Preset.
+// The enhanced models are only available for some languages, so they are not enabled by default.
+// The default preset leaves the model to the recognizer, as before presets existed.
+var presets = map[string]Preset{
+	"sermon": {
+		InteractionType:    speechpb.RecognitionMetadata_PRESENTATION,
+		MicrophoneDistance: speechpb.RecognitionMetadata_MIDFIELD,
+		MediaType:          speechpb.RecognitionMetadata_AUDIO,
+		DeviceType:         speechpb.RecognitionMetadata_OTHER_INDOOR_DEVICE,
+	},
+	"interview": {
+		Model:              "default",
+		InteractionType:    speechpb.RecognitionMetadata_DISCUSSION,
+		MicrophoneDistance: speechpb.RecognitionMetadata_NEARFIELD,
+		MediaType:          speechpb.RecognitionMetadata_AUDIO,
+		DeviceType:         speechpb.RecognitionMetadata_OTHER_INDOOR_DEVICE,
+	},
+	"music_video": {
+		Model:              "default",
+		InteractionType:    speechpb.RecognitionMetadata_PROFESSIONALLY_PRODUCED,
+		MicrophoneDistance: speechpb.RecognitionMetadata_NEARFIELD,
+		MediaType:          speechpb.RecognitionMetadata_VIDEO,
+		DeviceType:         speechpb.RecognitionMetadata_OTHER_INDOOR_DEVICE,
+	},
+	"phone_call": {
+		Model:              "phone_call",
+		InteractionType:    speechpb.RecognitionMetadata_PHONE_CALL,
+		MicrophoneDistance: speechpb.RecognitionMetadata_NEARFIELD,
+		MediaType:          speechpb.RecognitionMetadata_AUDIO,
+		DeviceType:         speechpb.RecognitionMetadata_PHONE_LINE,
+	},
+}
+
+// enumValue looks up a value in one of the protobuf enum maps, ignoring case
+func enumValue(values map[string]int32, name, field string) (int32, error) {
+	v, ok := values[strings.ToUpper(name)]
+	if !ok {
+		return 0, fmt.Errorf("Unknown %s: \"%s\"", field, name)
+	}
+	return v, nil
+}
+
+// settings returns the preset of the request with the explicitly requested values applied
+func (r IngestRequest) settings() (Preset, error) {
+	name := r.Preset
+	if name == "" {
+		name = DefaultPreset
+	}
+
+	p, ok := presets[strings.ToLower(name)]
+	if !ok {
+		return p, fmt.Errorf("Unknown preset: \"%s\"", r.Preset)
+	}
+
+	if r.Model != "" {
+		if !models[strings.ToLower(r.Model)] {
+			return p, fmt.Errorf("Unknown model: \"%s\"", r.Model)
+		}
+		p.Model = strings.ToLower(r.Model)
+	}
+
+	p.UseEnhanced = p.UseEnhanced || r.UseEnhanced
+
+	if r.InteractionType != "" {
+		v, err := enumValue(speechpb.RecognitionMetadata_InteractionType_value, r.InteractionType, "interaction type")
+		if err != nil {
+			return p, err
+		}
+		p.InteractionType = speechpb.RecognitionMetadata_InteractionType(v)
+	}
+
+	if r.MicrophoneDistance != "" {
+		v, err := enumValue(speechpb.RecognitionMetadata_MicrophoneDistance_value, r.MicrophoneDistance, "microphone distance")
+		if err != nil {
+			return p, err
+		}
+		p.MicrophoneDistance = speechpb.RecognitionMetadata_MicrophoneDistance(v)
+	}
+
+	if r.MediaType != "" {
+		v, err := enumValue(speechpb.RecognitionMetadata_OriginalMediaType_value, r.MediaType, "media type")
+		if err != nil {
+			return p, err
+		}
+		p.MediaType = speechpb.RecognitionMetadata_OriginalMediaType(v)
+	}
+
+	if r.DeviceType != "" {
+		v, err := enumValue(speechpb.RecognitionMetadata_RecordingDeviceType_value, r.DeviceType, "device type")
+		if err != nil {
+			return p, err
+		}
+		p.DeviceType = speechpb.RecognitionMetadata_RecordingDeviceType(v)
+	}
+
+	return p, nil
+}
+
+func (r IngestRequest) validateFeatures() error {
+	if len(r.AlternativeLanguages) > MaxAlternativeLanguages {
+		return fmt.Errorf("At most %d alternative languages are supported", MaxAlternativeLanguages)
+	}
+
+	for _, lang := range r.AlternativeLanguages {
+		if lang == "" || strings.EqualFold(lang, r.Language) {
+			return fmt.Errorf("Invalid alternative language: \"%s\"", lang)
+		}
+	}
+
+	if r.MaxAlternatives < 0 || r.MaxAlternatives > MaxAlternatives {
+		return fmt.Errorf("Max alternatives must be between 0 and %d", MaxAlternatives)
+	}
+
+	_, err := r.settings()
+	return err
+}
+
+// recognitionConfig builds the recognizer configuration for the audio described by the request.
+// The request must be validated first.
+func recognitionConfig(audio IngestRequest) *speechpb.RecognitionConfig {
+	settings, _ := audio.settings()
+
+	return &speechpb.RecognitionConfig{
+		Encoding:                   audio.Encoding(),
+		SampleRateHertz:            audio.SampleRateHertz,
+		AudioChannelCount:          audio.Channels,
+		LanguageCode:               audio.Language,
+		AlternativeLanguageCodes:   audio.AlternativeLanguages,
+		MaxAlternatives:            audio.MaxAlternatives,
+		ProfanityFilter:            audio.ProfanityFilter,
+		SpeechContexts:             speechContexts(audio.Phrases),
+		EnableAutomaticPunctuation: true,
+		EnableWordTimeOffsets:      true,
+		EnableWordConfidence:       true,
+		Model:                      settings.Model,
+		UseEnhanced:                settings.UseEnhanced,
+		Metadata: &speechpb.RecognitionMetadata{
+			InteractionType:     settings.InteractionType,
+			MicrophoneDistance:  settings.MicrophoneDistance,
+			OriginalMediaType:   settings.MediaType,
+			RecordingDeviceType: settings.DeviceType,
+		},
+	}
+}
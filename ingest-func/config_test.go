@@ -0,0 +1,45 @@
+package stt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1p1beta1"
+	"google.golang.org/protobuf/proto"
+)
+
+func Test_recognitionConfig(t *testing.T) {
+	// Defaults are unchanged from before presets existed, except for the word confidence
+	config := recognitionConfig(IngestRequest{File: "gs://b/a.flac", Language: "no-NO", EncodingString: "FLAC", SampleRateHertz: 48000, Channels: 2})
+	expected := &speechpb.RecognitionConfig{
+		Encoding:                   speechpb.RecognitionConfig_FLAC,
+		SampleRateHertz:            48000,
+		AudioChannelCount:          2,
+		LanguageCode:               "no-NO",
+		SpeechContexts:             []*speechpb.SpeechContext{},
+		EnableAutomaticPunctuation: true,
+		EnableWordTimeOffsets:      true,
+		EnableWordConfidence:       true,
+		Metadata: &speechpb.RecognitionMetadata{
+			InteractionType:     speechpb.RecognitionMetadata_PRESENTATION,
+			MicrophoneDistance:  speechpb.RecognitionMetadata_MIDFIELD,
+			OriginalMediaType:   speechpb.RecognitionMetadata_AUDIO,
+			RecordingDeviceType: speechpb.RecognitionMetadata_OTHER_INDOOR_DEVICE,
+		},
+	}
+	assert.True(t, proto.Equal(expected, config), "%v", config)
+
+	config = recognitionConfig(IngestRequest{File: "gs://b/a.flac", Preset: "phone_call", MicrophoneDistance: "farfield", UseEnhanced: true})
+	assert.Equal(t, "phone_call", config.Model)
+	assert.True(t, config.UseEnhanced)
+	assert.Equal(t, speechpb.RecognitionMetadata_PHONE_LINE, config.Metadata.RecordingDeviceType)
+	assert.Equal(t, speechpb.RecognitionMetadata_FARFIELD, config.Metadata.MicrophoneDistance)
+}
+
+func Test_validateFeatures(t *testing.T) {
+	assert.NoError(t, IngestRequest{File: "gs://b/a.flac", Preset: "Interview", Model: "video", MaxAlternatives: 5}.Validate())
+	assert.Error(t, IngestRequest{File: "gs://b/a.flac", Preset: "podcast"}.Validate())
+	assert.Error(t, IngestRequest{File: "gs://b/a.flac", Model: "latest"}.Validate())
+	assert.Error(t, IngestRequest{File: "gs://b/a.flac", InteractionType: "sermon"}.Validate())
+	assert.Error(t, IngestRequest{File: "gs://b/a.flac", MaxAlternatives: 31}.Validate())
+}
@@ -0,0 +1,142 @@
+package stt
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1p1beta1"
+)
+
+// encodingNames maps the accepted values of IngestRequest.EncodingString to the recognizer encoding.
+// The short names (PCM, OPUS) are kept for backwards compatibility.
+var encodingNames = map[string]speechpb.RecognitionConfig_AudioEncoding{
+	"PCM":                    speechpb.RecognitionConfig_LINEAR16,
+	"LINEAR16":               speechpb.RecognitionConfig_LINEAR16,
+	"WAV":                    speechpb.RecognitionConfig_LINEAR16,
+	"FLAC":                   speechpb.RecognitionConfig_FLAC,
+	"MULAW":                  speechpb.RecognitionConfig_MULAW,
+	"ULAW":                   speechpb.RecognitionConfig_MULAW,
+	"AMR":                    speechpb.RecognitionConfig_AMR,
+	"AMR_WB":                 speechpb.RecognitionConfig_AMR_WB,
+	"OPUS":                   speechpb.RecognitionConfig_OGG_OPUS,
+	"OGG_OPUS":               speechpb.RecognitionConfig_OGG_OPUS,
+	"SPEEX":                  speechpb.RecognitionConfig_SPEEX_WITH_HEADER_BYTE,
+	"SPEEX_WITH_HEADER_BYTE": speechpb.RecognitionConfig_SPEEX_WITH_HEADER_BYTE,
+	"MP3":                    speechpb.RecognitionConfig_MP3,
+}
+
+// encodingExtensions is used to guess the encoding when none was provided in the request.
+// WebM is not listed on purpose, the recognizer does not accept it and it is transcoded instead.
+var encodingExtensions = map[string]speechpb.RecognitionConfig_AudioEncoding{
+	".wav":   speechpb.RecognitionConfig_LINEAR16,
+	".pcm":   speechpb.RecognitionConfig_LINEAR16,
+	".flac":  speechpb.RecognitionConfig_FLAC,
+	".ul":    speechpb.RecognitionConfig_MULAW,
+	".ulaw":  speechpb.RecognitionConfig_MULAW,
+	".mulaw": speechpb.RecognitionConfig_MULAW,
+	".amr":   speechpb.RecognitionConfig_AMR,
+	".awb":   speechpb.RecognitionConfig_AMR_WB,
+	".ogg":   speechpb.RecognitionConfig_OGG_OPUS,
+	".oga":   speechpb.RecognitionConfig_OGG_OPUS,
+	".opus":  speechpb.RecognitionConfig_OGG_OPUS,
+	".spx":   speechpb.RecognitionConfig_SPEEX_WITH_HEADER_BYTE,
+	".mp3":   speechpb.RecognitionConfig_MP3,
+}
+
+// sampleRateRule describes which sample rates the recognizer accepts for an encoding
+type sampleRateRule struct {
+	Min int32
+	Max int32
+
+	// Allowed lists the exact rates accepted. If empty, any rate between Min and Max is fine
+	Allowed []int32
+
+	// Optional is true if the rate can be omitted because it is read from the file header
+	Optional bool
+}
+
+// sampleRates is based on the documentation of RecognitionConfig.AudioEncoding:
+// https://cloud.google.com/speech-to-text/docs/reference/rpc/google.cloud.speech.v1p1beta1#audioencoding
+var sampleRates = map[speechpb.RecognitionConfig_AudioEncoding]sampleRateRule{
+	speechpb.RecognitionConfig_LINEAR16:               {Min: 8000, Max: 48000, Optional: true},
+	speechpb.RecognitionConfig_FLAC:                   {Min: 8000, Max: 48000, Optional: true},
+	speechpb.RecognitionConfig_MULAW:                  {Min: 8000, Max: 48000},
+	speechpb.RecognitionConfig_AMR:                    {Allowed: []int32{8000}},
+	speechpb.RecognitionConfig_AMR_WB:                 {Allowed: []int32{16000}},
+	speechpb.RecognitionConfig_OGG_OPUS:               {Allowed: []int32{8000, 12000, 16000, 24000, 48000}},
+	speechpb.RecognitionConfig_SPEEX_WITH_HEADER_BYTE: {Allowed: []int32{16000}},
+	speechpb.RecognitionConfig_MP3:                    {Min: 8000, Max: 48000},
+}
+
+func (rule sampleRateRule) accepts(rate int32) bool {
+	if rate == 0 {
+		return rule.Optional
+	}
+
+	if len(rule.Allowed) == 0 {
+		return rate >= rule.Min && rate <= rule.Max
+	}
+
+	for _, a := range rule.Allowed {
+		if a == rate {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (rule sampleRateRule) String() string {
+	if len(rule.Allowed) == 0 {
+		return fmt.Sprintf("%d-%d Hz", rule.Min, rule.Max)
+	}
+
+	rates := []string{}
+	for _, a := range rule.Allowed {
+		rates = append(rates, fmt.Sprintf("%d", a))
+	}
+	return fmt.Sprintf("%s Hz", strings.Join(rates, ", "))
+}
+
+// Encoding as the protobuf version
+//
+// If no encoding was provided it is inferred from the file extension
+func (r IngestRequest) Encoding() speechpb.RecognitionConfig_AudioEncoding {
+	if r.EncodingString == "" {
+		if enc, ok := encodingExtensions[strings.ToLower(path.Ext(r.File))]; ok {
+			return enc
+		}
+
+		log.Printf("Unable to infer encoding from: %s", r.File)
+		return speechpb.RecognitionConfig_ENCODING_UNSPECIFIED
+	}
+
+	if enc, ok := encodingNames[strings.ToUpper(r.EncodingString)]; ok {
+		return enc
+	}
+
+	log.Printf("Unknown encoding: %s", r.EncodingString)
+	return speechpb.RecognitionConfig_ENCODING_UNSPECIFIED
+}
+
+func (r IngestRequest) validateEncoding() error {
+	enc := r.Encoding()
+	if enc == speechpb.RecognitionConfig_ENCODING_UNSPECIFIED {
+		if r.EncodingString == "" {
+			return fmt.Errorf("Unable to infer encoding from \"%s\", please specify one", r.File)
+		}
+		return fmt.Errorf("Unsupported encoding: \"%s\"", r.EncodingString)
+	}
+
+	rule := sampleRates[enc]
+	if !rule.accepts(r.SampleRateHertz) {
+		if r.SampleRateHertz == 0 {
+			return fmt.Errorf("Sample rate is required for %s (%s)", enc, rule)
+		}
+		return fmt.Errorf("Sample rate %d Hz is not supported for %s (%s)", r.SampleRateHertz, enc, rule)
+	}
+
+	return nil
+}
@@ -0,0 +1,28 @@
+package stt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1p1beta1"
+)
+
+func Test_Encoding(t *testing.T) {
+	assert.Equal(t, speechpb.RecognitionConfig_LINEAR16, IngestRequest{EncodingString: "pcm"}.Encoding())
+	assert.Equal(t, speechpb.RecognitionConfig_MP3, IngestRequest{EncodingString: "MP3"}.Encoding())
+	assert.Equal(t, speechpb.RecognitionConfig_MULAW, IngestRequest{File: "gs://b/phone.ul"}.Encoding())
+	assert.Equal(t, speechpb.RecognitionConfig_FLAC, IngestRequest{File: "gs://b/a.FLAC"}.Encoding())
+	assert.Equal(t, speechpb.RecognitionConfig_ENCODING_UNSPECIFIED, IngestRequest{File: "gs://b/a.webm"}.Encoding())
+	assert.Equal(t, speechpb.RecognitionConfig_ENCODING_UNSPECIFIED, IngestRequest{EncodingString: "AAC"}.Encoding())
+}
+
+func Test_Validate(t *testing.T) {
+	assert.NoError(t, IngestRequest{File: "gs://b/a.flac"}.Validate())
+	assert.NoError(t, IngestRequest{File: "gs://b/a.opus", SampleRateHertz: 48000}.Validate())
+	assert.NoError(t, IngestRequest{EncodingString: "AMR_WB", SampleRateHertz: 16000}.Validate())
+
+	assert.Error(t, IngestRequest{File: "gs://b/a.opus", SampleRateHertz: 44100}.Validate())
+	assert.Error(t, IngestRequest{File: "gs://b/a.mp3"}.Validate())
+	assert.Error(t, IngestRequest{EncodingString: "AMR", SampleRateHertz: 16000}.Validate())
+	assert.Error(t, IngestRequest{File: "gs://b/a.txt"}.Validate())
+}
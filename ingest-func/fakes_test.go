@@ -0,0 +1,329 @@
+package stt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	speech "cloud.google.com/go/speech/apiv1p1beta1"
+	"cloud.google.com/go/storage"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/option"
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1p1beta1"
+	longrunningpb "google.golang.org/genproto/googleapis/longrunning"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// fakeObject is an object stored in fakeStorage
+type fakeObject struct {
+	data       []byte
+	generation int64
+	metadata   map[string]string
+	created    time.Time
+}
+
+// fakeStorage is an in-memory stand-in for the parts of the cloud storage API the functions use,
+// including the generation preconditions
+type fakeStorage struct {
+	mu         sync.Mutex
+	objects    map[string]*fakeObject
+	generation int64
+}
+
+// newFakeStorage returns a storage client that talks to a fakeStorage
+func newFakeStorage(t *testing.T) (*storage.Client, *fakeStorage) {
+	fake := &fakeStorage{objects: map[string]*fakeObject{}}
+	client, err := storage.NewClient(context.Background(),
+		option.WithHTTPClient(&http.Client{Transport: fake}),
+		option.WithEndpoint("http://storage.fake/storage/v1/"),
+	)
+	assert.NoError(t, err)
+	return client, fake
+}
+
+// put stores an object, like an upload without conditions
+func (f *fakeStorage) put(bucket, name string, data []byte, metadata map[string]string) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.generation++
+	f.objects[bucket+"/"+name] = &fakeObject{data: data, generation: f.generation, metadata: metadata, created: time.Now()}
+	return f.generation
+}
+
+// get returns the content of an object, or nil if it does not exist
+func (f *fakeStorage) get(bucket, name string) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if o, ok := f.objects[bucket+"/"+name]; ok {
+		return o.data
+	}
+	return nil
+}
+
+// putStatus stores a status file like writeStatus does
+func (f *fakeStorage) putStatus(t *testing.T, bucket, name string, s FileStatus) {
+	data, err := json.Marshal(s)
+	assert.NoError(t, err)
+	f.put(bucket, name, data, s.queueMetadata())
+}
+
+// getStatus reads a status file, the status is empty if it does not exist
+func (f *fakeStorage) getStatus(t *testing.T, bucket, name string) FileStatus {
+	data := f.get(bucket, name)
+	if data == nil {
+		return FileStatus{}
+	}
+	s, err := decodeStatus(data)
+	assert.NoError(t, err)
+	return s
+}
+
+// checkConditions returns the http status for the precondition query parameters on the object,
+// or 0 if they hold
+func checkConditions(o *fakeObject, query url.Values, prefix string) int {
+	if v := query.Get(prefix + "GenerationMatch"); v != "" {
+		gen, _ := strconv.ParseInt(v, 10, 64)
+		if (gen == 0 && o != nil) || (gen != 0 && (o == nil || o.generation != gen)) {
+			return http.StatusPreconditionFailed
+		}
+	}
+	return 0
+}
+
+func (o *fakeObject) resource(bucket, name string) map[string]interface{} {
+	return map[string]interface{}{
+		"bucket":      bucket,
+		"name":        name,
+		"generation":  strconv.FormatInt(o.generation, 10),
+		"size":        strconv.Itoa(len(o.data)),
+		"metadata":    o.metadata,
+		"timeCreated": o.created.Format(time.RFC3339Nano),
+	}
+}
+
+// RoundTrip serves the requests of the storage client
+func (f *fakeStorage) RoundTrip(r *http.Request) (*http.Response, error) {
+	w := httptest.NewRecorder()
+	f.serve(w, r)
+	return w.Result(), nil
+}
+
+func sendJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func sendAPIError(w http.ResponseWriter, code int) {
+	sendJSON(w, code, map[string]interface{}{"error": map[string]interface{}{"code": code, "message": http.StatusText(code)}})
+}
+
+func (f *fakeStorage) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	query := r.URL.Query()
+	parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/")
+	for i := range parts {
+		parts[i], _ = url.PathUnescape(parts[i])
+	}
+
+	switch {
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/upload/storage/v1/b/"):
+		// Multipart upload: /upload/storage/v1/b/<bucket>/o
+		bucket := parts[4]
+		_, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		reader := multipart.NewReader(r.Body, params["boundary"])
+		part, _ := reader.NextPart()
+		attrs := struct {
+			Name     string            `json:"name"`
+			Metadata map[string]string `json:"metadata"`
+		}{}
+		json.NewDecoder(part).Decode(&attrs)
+		part, _ = reader.NextPart()
+		data, _ := ioutil.ReadAll(part)
+
+		key := bucket + "/" + attrs.Name
+		if code := checkConditions(f.objects[key], query, "if"); code != 0 {
+			sendAPIError(w, code)
+			return
+		}
+		f.generation++
+		o := &fakeObject{data: data, generation: f.generation, metadata: attrs.Metadata, created: time.Now()}
+		f.objects[key] = o
+		sendJSON(w, http.StatusOK, o.resource(bucket, attrs.Name))
+
+	case strings.HasPrefix(r.URL.Path, "/storage/v1/b/") && len(parts) == 5 && r.Method == http.MethodGet:
+		// List: /storage/v1/b/<bucket>/o
+		bucket := parts[3]
+		items := []interface{}{}
+		for key, o := range f.objects {
+			if name := strings.TrimPrefix(key, bucket+"/"); name != key && strings.HasPrefix(name, query.Get("prefix")) {
+				items = append(items, o.resource(bucket, name))
+			}
+		}
+		sendJSON(w, http.StatusOK, map[string]interface{}{"kind": "storage#objects", "items": items})
+
+	case strings.HasPrefix(r.URL.Path, "/storage/v1/b/") && len(parts) == 10 && parts[6] == "rewriteTo":
+		// Copy: /storage/v1/b/<bucket>/o/<object>/rewriteTo/b/<bucket>/o/<object>
+		src := f.objects[parts[3]+"/"+parts[5]]
+		if src == nil {
+			sendAPIError(w, http.StatusNotFound)
+			return
+		}
+		if code := checkConditions(src, query, "ifSource"); code != 0 {
+			sendAPIError(w, code)
+			return
+		}
+		f.generation++
+		o := &fakeObject{data: src.data, generation: f.generation, metadata: src.metadata, created: time.Now()}
+		f.objects[parts[7]+"/"+parts[9]] = o
+		sendJSON(w, http.StatusOK, map[string]interface{}{
+			"kind":                "storage#rewriteResponse",
+			"done":                true,
+			"totalBytesRewritten": strconv.Itoa(len(o.data)),
+			"objectSize":          strconv.Itoa(len(o.data)),
+			"resource":            o.resource(parts[7], parts[9]),
+		})
+
+	case strings.HasPrefix(r.URL.Path, "/storage/v1/b/") && len(parts) == 6:
+		// Object: /storage/v1/b/<bucket>/o/<object>
+		key := parts[3] + "/" + parts[5]
+		o := f.objects[key]
+		if o == nil {
+			sendAPIError(w, http.StatusNotFound)
+			return
+		}
+		if code := checkConditions(o, query, "if"); code != 0 {
+			sendAPIError(w, code)
+			return
+		}
+
+		if r.Method == http.MethodDelete {
+			delete(f.objects, key)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		sendJSON(w, http.StatusOK, o.resource(parts[3], parts[5]))
+
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		// Download: /<bucket>/<object>
+		key := strings.TrimPrefix(r.URL.Path, "/")
+		o := f.objects[key]
+		if o == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if code := checkConditions(o, query, "if"); code != 0 {
+			w.WriteHeader(code)
+			return
+		}
+		w.Header().Set("X-Goog-Generation", strconv.FormatInt(o.generation, 10))
+		w.Header().Set("Content-Length", strconv.Itoa(len(o.data)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(o.data)
+
+	default:
+		sendAPIError(w, http.StatusNotImplemented)
+	}
+}
+
+// fakeSpeech is a stand-in for the speech API and its operations.
+// onStart and onGet are called while an operation is started or polled.
+type fakeSpeech struct {
+	speechpb.UnimplementedSpeechServer
+	longrunningpb.UnimplementedOperationsServer
+
+	mu         sync.Mutex
+	started    int
+	operations map[string]*longrunningpb.Operation
+	cancelled  []string
+
+	onStart func()
+	onGet   func()
+}
+
+// newFakeSpeech starts a fakeSpeech server and returns a client for it and a function that stops both
+func newFakeSpeech(t *testing.T) (*speech.Client, *fakeSpeech, func()) {
+	fake := &fakeSpeech{operations: map[string]*longrunningpb.Operation{}}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	server := grpc.NewServer()
+	speechpb.RegisterSpeechServer(server, fake)
+	longrunningpb.RegisterOperationsServer(server, fake)
+	go server.Serve(lis)
+
+	client, err := speech.NewClient(context.Background(),
+		option.WithEndpoint(lis.Addr().String()),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithInsecure()),
+	)
+	assert.NoError(t, err)
+	return client, fake, func() {
+		client.Close()
+		server.Stop()
+	}
+}
+
+// setOperation stores the state an operation is polled with
+func (f *fakeSpeech) setOperation(op *longrunningpb.Operation) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.operations[op.Name] = op
+}
+
+// doneOperation is a finished operation with the results
+func doneOperation(t *testing.T, name string, results ...*speechpb.SpeechRecognitionResult) *longrunningpb.Operation {
+	resp, err := anypb.New(&speechpb.LongRunningRecognizeResponse{Results: results})
+	assert.NoError(t, err)
+	return &longrunningpb.Operation{Name: name, Done: true, Result: &longrunningpb.Operation_Response{Response: resp}}
+}
+
+func (f *fakeSpeech) LongRunningRecognize(ctx context.Context, req *speechpb.LongRunningRecognizeRequest) (*longrunningpb.Operation, error) {
+	if f.onStart != nil {
+		f.onStart()
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.started++
+	op := &longrunningpb.Operation{Name: fmt.Sprintf("op%d", f.started)}
+	f.operations[op.Name] = op
+	return op, nil
+}
+
+func (f *fakeSpeech) GetOperation(ctx context.Context, req *longrunningpb.GetOperationRequest) (*longrunningpb.Operation, error) {
+	if f.onGet != nil {
+		f.onGet()
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	op, ok := f.operations[req.Name]
+	if !ok {
+		return nil, fmt.Errorf("unknown operation %s", req.Name)
+	}
+	return op, nil
+}
+
+func (f *fakeSpeech) CancelOperation(ctx context.Context, req *longrunningpb.CancelOperationRequest) (*emptypb.Empty, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cancelled = append(f.cancelled, req.Name)
+	return &emptypb.Empty{}, nil
+}
@@ -6,8 +6,10 @@ require (
 	cloud.google.com/go v0.75.0
 	cloud.google.com/go/storage v1.10.0
 	github.com/asticode/go-astisub v0.12.0
-	github.com/stretchr/testify v1.7.0 // indirect
+	github.com/stretchr/testify v1.7.0
+	golang.org/x/oauth2 v0.0.0-20201208152858-08078c50e5b5
 	google.golang.org/api v0.36.0
 	google.golang.org/genproto v0.0.0-20210114201628-6edceaf6022f
 	google.golang.org/grpc v1.34.0
+	google.golang.org/protobuf v1.25.0
 )
@@ -0,0 +1,134 @@
+package stt
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// rightToLeftMark is prepended to lines in right-to-left languages so players align them correctly
+const rightToLeftMark = "\u200f"
+
+// noBreakSpace keeps punctuation on the same line as the word before it
+const noBreakSpace = "\u00a0"
+
+// LanguageRules controls how words are joined and split into lines for a language
+type LanguageRules struct {
+	// CharsPerLine limits the length of a subtitle line
+	CharsPerLine int
+	// CharsPerLineText limits the length of a line in the text format
+	CharsPerLineText int
+	// NoSpaces is true for languages that do not put spaces between words
+	NoSpaces bool
+	// SpaceBeforePunctuation inserts a no-break space before ? ! : and ; (French typography)
+	SpaceBeforePunctuation bool
+	// NoBreakAfter lists words (articles, prepositions) a line should not end with
+	NoBreakAfter map[string]bool
+	// RightToLeft marks each line with a right-to-left mark
+	RightToLeft bool
+}
+
+var defaultRules = LanguageRules{
+	CharsPerLine:     CharsPerLine,
+	CharsPerLineText: CharsPerLineText,
+}
+
+func words(s string) map[string]bool {
+	m := map[string]bool{}
+	for _, w := range strings.Fields(s) {
+		m[w] = true
+	}
+	return m
+}
+
+var norwegianNoBreak = words("en ei et i på av til med fra om for ved")
+
+// languageRules by the language part of the language code.
+// The CJK line lengths are based on the Netflix timed text style guides.
+var languageRules = map[string]LanguageRules{
+	"en": {NoBreakAfter: words("a an the of to in on at for with from by")},
+	"no": {NoBreakAfter: norwegianNoBreak},
+	"nb": {NoBreakAfter: norwegianNoBreak},
+	"nn": {NoBreakAfter: norwegianNoBreak},
+	"sv": {NoBreakAfter: words("en ett i på av till med från om för")},
+	"da": {NoBreakAfter: words("en et i på af til med fra om for")},
+	"de": {NoBreakAfter: words("der die das den dem des ein eine einen einem einer zu von mit in an auf für bei aus")},
+	"fr": {NoBreakAfter: words("le la les l' un une des du de à au aux en dans pour par sur avec"), SpaceBeforePunctuation: true},
+	"es": {NoBreakAfter: words("el la los las un una de a en con por para")},
+	"ja": {CharsPerLine: 13, CharsPerLineText: 40, NoSpaces: true},
+	"zh": {CharsPerLine: 16, CharsPerLineText: 40, NoSpaces: true},
+	"ko": {CharsPerLine: 16, CharsPerLineText: 40},
+	"ar": {RightToLeft: true},
+	"fa": {RightToLeft: true},
+	"ur": {RightToLeft: true},
+	"he": {RightToLeft: true},
+	"iw": {RightToLeft: true},
+}
+
+// rulesFor returns the rules for a language code like "nb-NO", filled with the defaults
+func rulesFor(lang string) LanguageRules {
+	base := strings.ToLower(strings.SplitN(strings.Replace(lang, "_", "-", -1), "-", 2)[0])
+
+	rules, ok := languageRules[base]
+	if !ok {
+		return defaultRules
+	}
+
+	if rules.CharsPerLine == 0 {
+		rules.CharsPerLine = defaultRules.CharsPerLine
+	}
+
+	if rules.CharsPerLineText == 0 {
+		rules.CharsPerLineText = defaultRules.CharsPerLineText
+	}
+
+	return rules
+}
+
+const punctuationWithSpace = "?!:;"
+
+// appendWord adds a word to the line, applying the spacing rules
+func (r LanguageRules) appendWord(line, word string) string {
+	separator := " "
+	if r.NoSpaces {
+		separator = ""
+	}
+
+	if r.SpaceBeforePunctuation {
+		trimmed := strings.TrimRight(word, punctuationWithSpace)
+		if trimmed == "" {
+			// Punctuation recognized as a separate word
+			separator = noBreakSpace
+		} else if trimmed != word {
+			word = trimmed + noBreakSpace + word[len(trimmed):]
+		}
+	}
+
+	if line == "" {
+		return word
+	}
+	return line + separator + word
+}
+
+// shouldBreak is true if a new line should be started after lastWord.
+// Lines ending in a word from NoBreakAfter may exceed the limit by a quarter.
+func (r LanguageRules) shouldBreak(line, lastWord string, limit int) bool {
+	n := utf8.RuneCountInString(line)
+	if n <= limit {
+		return false
+	}
+
+	if n <= limit+limit/4 && r.NoBreakAfter[strings.ToLower(strings.Trim(lastWord, ".,\"«»"))] {
+		return false
+	}
+
+	return true
+}
+
+// finishLine prepares a completed line for output
+func (r LanguageRules) finishLine(line string) string {
+	line = strings.TrimSpace(line)
+	if r.RightToLeft && line != "" {
+		return rightToLeftMark + line
+	}
+	return line
+}
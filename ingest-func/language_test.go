@@ -0,0 +1,45 @@
+package stt
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1p1beta1"
+)
+
+func Test_rulesFor(t *testing.T) {
+	assert.Equal(t, 13, rulesFor("ja-JP").CharsPerLine)
+	assert.True(t, rulesFor("ja-JP").NoSpaces)
+	assert.Equal(t, CharsPerLine, rulesFor("nb-NO").CharsPerLine)
+	assert.True(t, rulesFor("nb_NO").NoBreakAfter["på"])
+	assert.Equal(t, defaultRules, rulesFor("xx"))
+}
+
+func Test_appendWord(t *testing.T) {
+	fr := rulesFor("fr-FR")
+	assert.Equal(t, "Pourquoi\u00a0?", fr.appendWord("", "Pourquoi?"))
+	assert.Equal(t, "Pourquoi\u00a0?", fr.appendWord("Pourquoi", "?"))
+	assert.Equal(t, "Bon. Alors", fr.appendWord("Bon.", "Alors"))
+
+	assert.Equal(t, "今日は", rulesFor("ja").appendWord("今日", "は"))
+	assert.Equal(t, "\u200fשלום", rulesFor("he-IL").finishLine(" שלום "))
+}
+
+func Test_shouldBreak(t *testing.T) {
+	en := rulesFor("en-US")
+	line := strings.Repeat("x", CharsPerLine+1)
+	assert.True(t, en.shouldBreak(line, "house", CharsPerLine))
+	assert.False(t, en.shouldBreak(line, "the", CharsPerLine))
+	assert.True(t, en.shouldBreak(line+strings.Repeat("x", CharsPerLine), "the", CharsPerLine))
+
+	// Characters are counted, not bytes
+	assert.False(t, en.shouldBreak(strings.Repeat("ø", CharsPerLine), "ø", CharsPerLine))
+}
+
+func Test_transcriptionToPlainText(t *testing.T) {
+	results := []*speechpb.SpeechRecognitionResult{testResult("", time.Second, "Où", "est-il?")}
+	assert.Equal(t, "00:00:01:00: Où est-il\u00a0?\n", transcriptionToPlainText(results, 25, true, rulesFor("fr-FR")))
+	assert.Equal(t, "Où est-il?\n", transcriptionToPlainText(results, 25, false, rulesFor("en-US")))
+}
@@ -21,6 +21,15 @@ func main() {
 	// Add your function here
 	fs["Ingest"] = stt.Ingest
 	fs["Restult"] = stt.ProcessResults
+	fs["Status"] = stt.Status
+	fs["Transition"] = stt.Transition
+	fs["ImportSubtitles"] = stt.ImportSubtitles
+	fs["Versions"] = stt.Versions
+	fs["Batch"] = stt.Batch
+	fs["UploadURL"] = stt.UploadURL
+	fs["Cancel"] = stt.Cancel
+	fs["Retry"] = stt.Retry
+	fs["StuckJobs"] = stt.StuckJobs
 
 	for name, handler := range fs {
 		http.HandleFunc(fmt.Sprintf("/%s", name), handler)
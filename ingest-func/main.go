@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math"
@@ -13,12 +14,13 @@ import (
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
-	speech "cloud.google.com/go/speech/apiv1"
+	speech "cloud.google.com/go/speech/apiv1p1beta1"
 	"cloud.google.com/go/storage"
 	"github.com/asticode/go-astisub"
 	"google.golang.org/api/iterator"
-	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1"
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1p1beta1"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
@@ -40,31 +42,121 @@ var (
 	resultBucketID = os.Getenv("RESULT_BUCKET")
 )
 
-// Status constants
+// Status constants, see transitions for the allowed changes
 const (
-	StatusProcessing = "processing"
-	StatusError      = "error"
-	StatusCompleted  = "completed"
+	StatusQueued      = "queued"
+	StatusProcessing  = "processing"
+	StatusError       = "error"
+	StatusTranscribed = "transcribed"
+	StatusNeedsReview = "needs_review"
+	StatusInReview    = "in_review"
+	StatusApproved    = "approved"
+	StatusPublished   = "published"
+	StatusCancelled   = "cancelled"
+
+	// Deprecated: StatusCompleted is how transcribed jobs were marked before the review workflow.
+	// Status files with it are read as StatusTranscribed, use that instead.
+	StatusCompleted = "completed"
 )
 
 // IngestRequest captures the submitted data
 type IngestRequest struct {
-	File            string `json:"file"`
-	Language        string `json:"lang"`
-	EncodingString  string `json:"encoding"`
-	SampleRateHertz int32  `json:"sample_rate"`
-	FPS             int32  `json:"fps"`
+	File                 string   `json:"file"`
+	Language             string   `json:"lang"`
+	AlternativeLanguages []string `json:"alt_langs,omitempty"`
+	EncodingString       string   `json:"encoding"`
+	SampleRateHertz      int32    `json:"sample_rate"`
+	FPS                  int32    `json:"fps"`
+	Channels             int32    `json:"channels"`
+	Transcode            bool     `json:"transcode"`
+	ChunkMinutes         int32    `json:"chunk_minutes"`
+
+	Phrases      []PhraseSet `json:"phrases,omitempty"`
+	Vocabularies []string    `json:"vocabularies,omitempty"`
+
+	// Preset selects the defaults for the fields below, see presets
+	Preset             string `json:"preset,omitempty"`
+	Model              string `json:"model,omitempty"`
+	UseEnhanced        bool   `json:"use_enhanced,omitempty"`
+	ProfanityFilter    bool   `json:"profanity_filter,omitempty"`
+	MaxAlternatives    int32  `json:"max_alternatives,omitempty"`
+	InteractionType    string `json:"interaction_type,omitempty"`
+	MicrophoneDistance string `json:"microphone_distance,omitempty"`
+	MediaType          string `json:"media_type,omitempty"`
+	DeviceType         string `json:"device_type,omitempty"`
+
+	// Script is the exact text of the file, which is used instead of the recognized text
+	Script string `json:"script,omitempty"`
+
+	// ReviewThreshold overrides the REVIEW_THRESHOLD of the mean word confidence, 0 never asks for review
+	ReviewThreshold *float32 `json:"review_threshold,omitempty"`
+
+	// NoCache recognizes the file even if the same audio was recognized with the same settings before
+	NoCache bool `json:"no_cache,omitempty"`
+
+	// Priority orders the queued jobs, higher is started first
+	Priority int32 `json:"priority,omitempty"`
+
+	// Checksum is verified when an http(s):// or s3:// file is downloaded, like "sha256:<hex>"
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// Validate checks that the encoding is supported, that the sample rate is allowed for it,
+// that the phrase hints are within the limits and that the recognition settings are known.
+// Files that will be transcoded are not checked, as the transcoded file is always FLAC.
+func (r IngestRequest) Validate() error {
+	if r.ChunkMinutes < 0 {
+		return fmt.Errorf("Field chunk_minutes can not be negative")
+	}
+
+	// Split files are transcoded as part of the splitting
+	if !r.NeedsTranscode() && r.ChunkMinutes == 0 {
+		if err := r.validateEncoding(); err != nil {
+			return err
+		}
+	}
+
+	if err := r.validatePhrases(); err != nil {
+		return err
+	}
+
+	if err := r.validateReviewThreshold(); err != nil {
+		return err
+	}
+
+	if r.Checksum != "" {
+		if _, err := parseChecksum(r.Checksum); err != nil {
+			return err
+		}
+	}
+
+	return r.validateFeatures()
 }
 
 // FileStatus is the structure written into the storage to keep track of the status
 type FileStatus struct {
 	IngestRequest
-	JobID      string `json:"job_id"`
-	Status     string `json:"status"`
-	Error      string `json:"error"`
-	SourceFile string `json:"source"`
-	TxtFile    string `json:"txt_file"`
-	JSONFile   string `json:"json_file"`
+	JobID          string              `json:"job_id"`
+	Status         string              `json:"status"`
+	Error          string              `json:"error"`
+	SourceFile     string              `json:"source"`
+	DownloadedFrom string              `json:"downloaded_from,omitempty"`
+	CacheKey       string              `json:"cache_key,omitempty"`
+	Cached         bool                `json:"cached,omitempty"`
+	TranscodedFile string              `json:"transcoded_file,omitempty"`
+	Chunks         []Chunk             `json:"chunks,omitempty"`
+	SpeechContexts []PhraseSet         `json:"speech_contexts,omitempty"`
+	Languages      []LanguageSpan      `json:"languages,omitempty"`
+	Confidence     *ConfidenceStats    `json:"confidence,omitempty"`
+	TxtFile        string              `json:"txt_file"`
+	SrtFile        string              `json:"srt_file"`
+	VttFile        string              `json:"vtt_file"`
+	JSONFile       string              `json:"json_file"`
+	History        []StatusChange      `json:"history,omitempty"`
+	Versions       []TranscriptVersion `json:"versions,omitempty"`
+	Attempts       []Attempt           `json:"attempts,omitempty"`
+	SubmittedAt    time.Time           `json:"submitted_at"`
+	Progress       *Progress           `json:"progress,omitempty"`
 }
 
 const transcriptionEmptyText = "Transcription empty"
@@ -75,13 +167,49 @@ func sendError(w http.ResponseWriter, message string, status int) {
 }
 
 func writeStatus(ctx context.Context, statusFile *storage.ObjectHandle, fStatus FileStatus) error {
+	_, err := writeStatusGeneration(ctx, statusFile, fStatus)
+	return err
+}
+
+// writeStatusGeneration is writeStatus returning the generation of the written file,
+// so it is only changed later if no one else changed it in the meantime
+func writeStatusGeneration(ctx context.Context, statusFile *storage.ObjectHandle, fStatus FileStatus) (int64, error) {
 	writer := statusFile.NewWriter(ctx)
+	writer.Metadata = fStatus.queueMetadata()
 	err := json.NewEncoder(writer).Encode(fStatus)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := writer.Close(); err != nil {
+		return 0, err
+	}
+	return writer.Attrs().Generation, nil
+}
+
+// finishStatus writes the last status of a job and moves it to done, unless the status
+// file was changed since statusFile was read
+func finishStatus(ctx context.Context, ingestBucket *storage.BucketHandle, statusFile *storage.ObjectHandle, fStatus FileStatus) error {
+	generation, err := writeStatusGeneration(ctx, statusFile, fStatus)
 	if err != nil {
 		return err
 	}
 
-	return writer.Close()
+	return renameStatus(ctx, ingestBucket, ingestBucket.Object(statusFile.ObjectName()).If(storage.Conditions{GenerationMatch: generation}), "done")
+}
+
+// statusChanged handles a status write that failed because someone else, like Cancel, changed the status.
+// The operations in started are not in the stored status, so they are cancelled.
+func statusChanged(ctx context.Context, client *speech.Client, bucket *storage.BucketHandle, fStatus FileStatus, started []string) {
+	current := "unknown"
+	if _, stored, err := findStatus(ctx, bucket, fStatus.SourceFile); err == nil {
+		current = stored.Status
+	}
+	log.Printf("Status of %s was changed to %s while it was processed, leaving it", fStatus.SourceFile, current)
+
+	if err := cancelOperations(ctx, client, started); err != nil {
+		log.Printf("Error cancelling operations of %s: %+v", fStatus.SourceFile, err)
+	}
 }
 
 func durationToFrameNumber(d time.Duration, fps int32) int64 {
@@ -116,7 +244,7 @@ func stringToSubItem(text string, start, end time.Duration) *astisub.Item {
 
 }
 
-func transcriptionToSrt(trans []*speechpb.SpeechRecognitionResult) *astisub.Subtitles {
+func transcriptionToSrt(trans []*speechpb.SpeechRecognitionResult, rules LanguageRules) *astisub.Subtitles {
 	subs := astisub.NewSubtitles()
 
 	if len(trans) == 0 {
@@ -131,58 +259,62 @@ func transcriptionToSrt(trans []*speechpb.SpeechRecognitionResult) *astisub.Subt
 	for _, r := range trans {
 		alt := r.Alternatives[0]
 		for _, w := range alt.Words {
-			if len(line) > CharsPerLine {
-				subs.Items = append(subs.Items, stringToSubItem(line, firstWord.StartTime.AsDuration(), lastWord.GetEndTime().AsDuration()))
+			if rules.shouldBreak(line, lastWord.GetWord(), rules.CharsPerLine) {
+				subs.Items = append(subs.Items, stringToSubItem(rules.finishLine(line), firstWord.StartTime.AsDuration(), lastWord.GetEndTime().AsDuration()))
 
 				// Start a new line
 				line = ""
 				firstWord = w
 			}
 
-			line += " " + w.Word
+			line = rules.appendWord(line, w.Word)
 			lastWord = w
 		}
 	}
 
-	subs.Items = append(subs.Items, stringToSubItem(line, firstWord.StartTime.AsDuration(), lastWord.GetEndTime().AsDuration()))
+	subs.Items = append(subs.Items, stringToSubItem(rules.finishLine(line), firstWord.StartTime.AsDuration(), lastWord.GetEndTime().AsDuration()))
 	return subs
 }
 
-func transcriptionToPlainText(trans []*speechpb.SpeechRecognitionResult, fps int32, timestamps bool) string {
+func transcriptionToPlainText(trans []*speechpb.SpeechRecognitionResult, fps int32, timestamps bool, rules LanguageRules) string {
 	if len(trans) == 0 {
 		return fmt.Sprintf("00:00:00.00 %s", transcriptionEmptyText)
 	}
 
 	lines := ""
 	line := ""
+	lastWord := ""
 
-	charsPerLine := CharsPerLineText
+	// Timestamp of the 1st word of the line
+	timestamp := ""
 	if timestamps {
-		// Inject timestamp of the 1st word for the 1st line
-		line = fmt.Sprintf("%s:", fmtDuration(trans[0].Alternatives[0].Words[0].StartTime.AsDuration(), fps))
+		timestamp = fmt.Sprintf("%s:", fmtDuration(trans[0].Alternatives[0].Words[0].StartTime.AsDuration(), fps))
 	}
 
+	// The timestamp counts towards the length of the line
+	charsPerLine := rules.CharsPerLineText - utf8.RuneCountInString(timestamp)
+
 	for _, r := range trans {
 		alt := r.Alternatives[0]
 		for _, w := range alt.Words {
-			if len(line) > charsPerLine {
-				lines += strings.TrimSpace(line) + "\n"
+			if rules.shouldBreak(line, lastWord, charsPerLine) {
+				lines += strings.TrimSpace(timestamp+" "+rules.finishLine(line)) + "\n"
 
 				// Start a new line
 				if timestamps {
-					line = fmt.Sprintf("%s:", fmtDuration(w.StartTime.AsDuration(), fps))
-				} else {
-					line = ""
+					timestamp = fmt.Sprintf("%s:", fmtDuration(w.StartTime.AsDuration(), fps))
 				}
+				line = ""
 			}
 
-			line += " " + w.Word
+			line = rules.appendWord(line, w.Word)
+			lastWord = w.Word
 		}
 	}
 
 	// Append the last generated line if it was not empty
 	if line != "" {
-		lines += strings.TrimSpace(line) + "\n"
+		lines += strings.TrimSpace(timestamp+" "+rules.finishLine(line)) + "\n"
 	}
 	return lines
 }
@@ -211,6 +343,10 @@ func ProcessResults(w http.ResponseWriter, r *http.Request) {
 
 	ingestBucket := storageClient.Bucket(ingestBucketID)
 	resultBucket := storageClient.Bucket(resultBucketID)
+
+	startQueued(ctx, client, ingestBucket)
+	deleteUnusedSidecars(ctx, ingestBucket)
+
 	objs := ingestBucket.Objects(ctx, &storage.Query{Prefix: "status/"})
 
 	// Work in batches of 10.
@@ -235,6 +371,11 @@ func ProcessResults(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
+		if attrs.Metadata["status"] == StatusQueued {
+			// Started by startQueued
+			continue
+		}
+
 		wg.Add(1)
 		go resultWorker(ctx, &wg, client, ingestBucket, resultBucket, attrs)
 
@@ -283,22 +424,28 @@ func resultWorker(ctx context.Context, wg *sync.WaitGroup, client *speech.Client
 	}
 
 	statusFileBytes, err := ioutil.ReadAll(reader)
+	reader.Close()
 	if err != nil {
 		log.Printf("Can't read status file: %+v", err)
 		return
 	}
 
-	fileStatus := FileStatus{}
-	err = json.Unmarshal(statusFileBytes, &fileStatus)
+	// Only write the status if no one else, like Cancel, changed it since it was read
+	statusFile = statusFile.If(storage.Conditions{GenerationMatch: reader.Attrs.Generation})
+
+	fileStatus, err := decodeStatus(statusFileBytes)
 	if err != nil {
 		log.Printf("Can't decode json: %+v", err)
 		renameStatus(ctx, ingestBucket, statusFile, "done")
 		return
 	}
+	readProgress := fileStatus.Progress
 
-	if fileStatus.Status == StatusCompleted {
-		// Temp bugfix for crashed files
-		fileStatus.Status = StatusProcessing
+	if fileStatus.Status == StatusTranscribed || fileStatus.Status == StatusNeedsReview {
+		// Crashed after the results were written, only the cleanup is missing
+		deleteSourceFiles(ctx, ingestBucket, fileStatus)
+		renameStatus(ctx, ingestBucket, statusFile, "done")
+		return
 	}
 
 	if fileStatus.Status == StatusError {
@@ -306,125 +453,218 @@ func resultWorker(ctx context.Context, wg *sync.WaitGroup, client *speech.Client
 		return
 	}
 
-	if fileStatus.JobID == "" || fileStatus.Status != StatusProcessing {
+	if fileStatus.Status == StatusCancelled {
+		// Normally moved by Cancel already
+		renameStatus(ctx, ingestBucket, statusFile, "done")
+		return
+	}
+
+	if (fileStatus.JobID == "" && len(fileStatus.Chunks) == 0) || fileStatus.Status != StatusProcessing {
 		// Not sent to transcription yet or already handled. Take it next time
 		return
 	}
 
-	op := client.LongRunningRecognizeOperation(fileStatus.JobID)
-	resp, err := op.Poll(ctx)
-	if err != nil {
-		log.Printf("Can't get op status: %+v", err)
-		fileStatus.Status = StatusError
-		fileStatus.Error = err.Error()
-		writeStatus(ctx, statusFile, fileStatus)
-		renameStatus(ctx, ingestBucket, statusFile, "done")
+	if fileStatus.expired(attrs.Created, time.Now()) {
+		log.Printf("%s is not done after %s, giving up", fileStatus.SourceFile, maxProcessingAge)
+		if err := cancelOperations(ctx, client, fileStatus.operationNames()); err != nil {
+			log.Printf("Error cancelling operations of %s: %+v", fileStatus.SourceFile, err)
+		}
+
+		fileStatus.fail(fmt.Errorf("Not done %s after it was submitted, the job was given up", maxProcessingAge))
+		if err := finishStatus(ctx, ingestBucket, statusFile, fileStatus); isConflict(err) {
+			statusChanged(ctx, client, ingestBucket, fileStatus, nil)
+		} else if err != nil {
+			log.Printf("Can't write status of %s: %+v", fileStatus.SourceFile, err)
+		}
 		return
 	}
 
-	if !op.Done() {
-		log.Printf("%s not done yet", fileStatus.JobID)
+	var results []*speechpb.SpeechRecognitionResult
+	var done bool
+	var progress *Progress
+	if len(fileStatus.Chunks) > 0 {
+		results, done, progress, err = pollChunks(ctx, client, fileStatus.Chunks)
+	} else {
+		results, done, progress, err = pollResults(ctx, client, fileStatus.JobID)
+	}
+
+	if progress.changed(fileStatus.Progress) {
+		fileStatus.Progress = progress.withETA()
+	}
+
+	if err != nil && !done && isTransient(err) {
+		log.Printf("Can't get op status of %s, trying again next time: %+v", fileStatus.SourceFile, err)
 		return
 	}
 
-	results := []*speechpb.SpeechRecognitionResult{}
-	for _, r := range resp.GetResults() {
-		results = append(results, r)
+	if status.Code(err) == codes.NotFound {
+		err = fmt.Errorf("The operation of the job no longer exists: %v", err)
 	}
 
-	txtFile := resultBucket.Object(fmt.Sprintf("%s.txt", fileStatus.SourceFile))
-	writer := txtFile.NewWriter(ctx)
-	_, err = writer.Write([]byte(transcriptionToPlainText(results, fileStatus.FPS, true)))
 	if err != nil {
-		log.Printf("Error writing results: %+v", err)
-		fileStatus.Status = StatusError
-		fileStatus.Error = err.Error()
-		writeStatus(ctx, statusFile, fileStatus)
-		renameStatus(ctx, ingestBucket, statusFile, "done")
+		log.Printf("Can't get op status: %+v", err)
+		fileStatus.fail(err)
+
+		if isTransient(err) && len(fileStatus.Attempts) < maxRetries {
+			err = fileStatus.restart(ctx, client, systemUser, fmt.Sprintf("Automatic retry after %s", status.Code(err)))
+			if isQuotaError(err) {
+				err = fileStatus.queueJob("Waiting for the speech API quota")
+			}
+
+			if err == nil {
+				log.Printf("Retrying %s, status %s, op id: %s", fileStatus.SourceFile, fileStatus.Status, fileStatus.JobID)
+				if err := writeStatus(ctx, statusFile, fileStatus); isConflict(err) {
+					statusChanged(ctx, client, ingestBucket, fileStatus, fileStatus.operationNames())
+				} else if err != nil {
+					log.Printf("Can't write status of %s, cancelling its operations: %+v", fileStatus.SourceFile, err)
+					cancelOperations(ctx, client, fileStatus.operationNames())
+				}
+				return
+			}
+
+			log.Printf("Can't retry %s: %+v", fileStatus.SourceFile, err)
+			cancelOperations(ctx, client, fileStatus.operationNames())
+			fileStatus.fail(err)
+		}
+
+		if err := finishStatus(ctx, ingestBucket, statusFile, fileStatus); isConflict(err) {
+			statusChanged(ctx, client, ingestBucket, fileStatus, nil)
+		} else if err != nil {
+			log.Printf("Can't write status of %s: %+v", fileStatus.SourceFile, err)
+		}
 		return
 	}
 
-	err = writer.Close()
+	if !done {
+		log.Printf("%s not done yet, %d%%", fileStatus.SourceFile, fileStatus.Progress.percent())
+		if progress.changed(readProgress) {
+			err := writeStatus(ctx, statusFile, fileStatus)
+			if err != nil && !isConflict(err) {
+				log.Printf("Can't write progress of %s: %+v", fileStatus.SourceFile, err)
+			}
+		}
+		return
+	}
+
+	err = writeOutputs(ctx, resultBucket, &fileStatus, fileStatus.withScript(results))
 	if err != nil {
-		log.Printf("Error closing writer: %+v", err)
-		fileStatus.Status = StatusError
-		fileStatus.Error = err.Error()
-		writeStatus(ctx, statusFile, fileStatus)
-		renameStatus(ctx, ingestBucket, statusFile, "done")
+		log.Printf("Error writing results: %+v", err)
+		fileStatus.fail(err)
+		if err := finishStatus(ctx, ingestBucket, statusFile, fileStatus); isConflict(err) {
+			statusChanged(ctx, client, ingestBucket, fileStatus, nil)
+		} else if err != nil {
+			log.Printf("Can't write status of %s: %+v", fileStatus.SourceFile, err)
+		}
 		return
 	}
 
-	srtFile := resultBucket.Object(fmt.Sprintf("%s.srt", fileStatus.SourceFile))
-	writer = srtFile.NewWriter(ctx)
-	subs := transcriptionToSrt(results)
-	err = subs.WriteToSRT(writer)
-	if err == astisub.ErrNoSubtitlesToWrite {
-		// Write empty file
-		writer.Write([]byte{})
+	if fileStatus.CacheKey != "" {
+		if err := writeCache(ctx, resultBucket, fileStatus.CacheKey, results); err != nil {
+			log.Printf("Error caching results of %s: %+v", fileStatus.SourceFile, err)
+		}
+	}
+
+	if err := fileStatus.setStatus(completedStatus(fileStatus), systemUser, ""); err != nil {
+		log.Printf("Can't complete %s: %+v", fileStatus.SourceFile, err)
+		fileStatus.fail(err)
+	}
+
+	generation, err := writeStatusGeneration(ctx, statusFile, fileStatus)
+	if isConflict(err) {
+		// The outputs are written, but the status someone else set is kept
+		statusChanged(ctx, client, ingestBucket, fileStatus, nil)
+		return
 	} else if err != nil {
-		log.Printf("Error writing SRT: %+v", err)
-		fileStatus.Status = StatusError
-		fileStatus.Error = err.Error()
-		writeStatus(ctx, statusFile, fileStatus)
-		renameStatus(ctx, ingestBucket, statusFile, "done")
+		log.Printf("Can't write status of %s: %+v", fileStatus.SourceFile, err)
 		return
 	}
 
-	err = writer.Close()
-	if err != nil {
-		log.Printf("Error closing SRT: %+v", err)
-		fileStatus.Status = StatusError
-		fileStatus.Error = err.Error()
-		writeStatus(ctx, statusFile, fileStatus)
-		renameStatus(ctx, ingestBucket, statusFile, "done")
-		return
+	deleteSourceFiles(ctx, ingestBucket, fileStatus)
+	renameStatus(ctx, ingestBucket, ingestBucket.Object(statusFile.ObjectName()).If(storage.Conditions{GenerationMatch: generation}), "done")
+}
+
+// deleteSourceFiles removes the source and all derived audio files of a job
+func deleteSourceFiles(ctx context.Context, bucket *storage.BucketHandle, fileStatus FileStatus) {
+	bucket.Object(fileStatus.SourceFile).Delete(ctx)
+	if fileStatus.TranscodedFile != "" {
+		bucket.Object(fileStatus.TranscodedFile).Delete(ctx)
+	}
+	for _, c := range fileStatus.Chunks {
+		bucket.Object(c.File).Delete(ctx)
 	}
+}
 
-	vttFile := resultBucket.Object(fmt.Sprintf("%s.vtt", fileStatus.SourceFile))
-	writer = vttFile.NewWriter(ctx)
-	err = subs.WriteToWebVTT(writer)
+// writeSubtitles writes subs into obj using one of the astisub writers
+func writeSubtitles(ctx context.Context, obj *storage.ObjectHandle, write func(io.Writer) error) error {
+	writer := obj.NewWriter(ctx)
+	err := write(writer)
 	if err == astisub.ErrNoSubtitlesToWrite {
 		// Write empty file
 		writer.Write([]byte{})
 	} else if err != nil {
-		log.Printf("Error writing VTT: %+v", err)
-		fileStatus.Status = StatusError
-		fileStatus.Error = err.Error()
-		writeStatus(ctx, statusFile, fileStatus)
-		renameStatus(ctx, ingestBucket, statusFile, "done")
-		return
+		writer.Close()
+		return err
+	}
+
+	return writer.Close()
+}
+
+// writeOutputs renders the results in all formats into the result bucket
+// and records the names of the created objects, the recognized languages
+// and the confidence statistics in fileStatus
+func writeOutputs(ctx context.Context, resultBucket *storage.BucketHandle, fileStatus *FileStatus, results []*speechpb.SpeechRecognitionResult) error {
+	return writeOutputsWithSubtitles(ctx, resultBucket, fileStatus, results, transcriptionToSrt(results, rulesFor(fileStatus.Language)))
+}
+
+// writeOutputsWithSubtitles is writeOutputs with the SRT and VTT files written from subs instead of the results
+func writeOutputsWithSubtitles(ctx context.Context, resultBucket *storage.BucketHandle, fileStatus *FileStatus, results []*speechpb.SpeechRecognitionResult, subs *astisub.Subtitles) error {
+	transcript := transcriptFromResults(results, fileStatus.Language)
+	confidence := transcript.markLowConfidence()
+
+	txtFile := resultBucket.Object(fmt.Sprintf("%s.txt", fileStatus.SourceFile))
+	writer := txtFile.NewWriter(ctx)
+	rules := rulesFor(fileStatus.Language)
+	_, err := writer.Write([]byte(transcriptionToPlainText(bracketLowConfidence(results), fileStatus.FPS, true, rules)))
+	if err != nil {
+		writer.Close()
+		return err
 	}
 
 	err = writer.Close()
 	if err != nil {
-		log.Printf("Error closing VTT: %+v", err)
-		fileStatus.Status = StatusError
-		fileStatus.Error = err.Error()
-		writeStatus(ctx, statusFile, fileStatus)
-		renameStatus(ctx, ingestBucket, statusFile, "done")
-		return
+		return fmt.Errorf("error closing TXT: %v", err)
 	}
 
-	fileStatus.Status = StatusCompleted
-	fileStatus.TxtFile = txtFile.ObjectName()
-	writeStatus(ctx, statusFile, fileStatus)
-	ingestBucket.Object(fileStatus.SourceFile).Delete(ctx)
-	renameStatus(ctx, ingestBucket, statusFile, "done")
-}
+	jsonFile := resultBucket.Object(fmt.Sprintf("%s.json", fileStatus.SourceFile))
+	writer = jsonFile.NewWriter(ctx)
+	err = json.NewEncoder(writer).Encode(transcript)
+	if err != nil {
+		writer.Close()
+		return fmt.Errorf("error writing JSON: %v", err)
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return fmt.Errorf("error closing JSON: %v", err)
+	}
+
+	srtFile := resultBucket.Object(fmt.Sprintf("%s.srt", fileStatus.SourceFile))
+	if err := writeSubtitles(ctx, srtFile, subs.WriteToSRT); err != nil {
+		return fmt.Errorf("error writing SRT: %v", err)
+	}
 
-// Encoding as the protobuf version
-func (r IngestRequest) Encoding() speechpb.RecognitionConfig_AudioEncoding {
-	switch strings.ToUpper(r.EncodingString) {
-	case "PCM":
-		return speechpb.RecognitionConfig_LINEAR16
-	case "OPUS":
-		return speechpb.RecognitionConfig_OGG_OPUS
-	case "FLAC":
-		return speechpb.RecognitionConfig_FLAC
+	vttFile := resultBucket.Object(fmt.Sprintf("%s.vtt", fileStatus.SourceFile))
+	if err := writeSubtitles(ctx, vttFile, subs.WriteToWebVTT); err != nil {
+		return fmt.Errorf("error writing VTT: %v", err)
 	}
 
-	log.Printf("Unknown encoding: %s", r.EncodingString)
-	return speechpb.RecognitionConfig_ENCODING_UNSPECIFIED
+	fileStatus.TxtFile = txtFile.ObjectName()
+	fileStatus.SrtFile = srtFile.ObjectName()
+	fileStatus.VttFile = vttFile.ObjectName()
+	fileStatus.JSONFile = jsonFile.ObjectName()
+	fileStatus.Languages = transcript.languageSpans()
+	fileStatus.Confidence = &confidence
+	return nil
 }
 
 // Ingest starts the transcription process
@@ -448,95 +688,315 @@ func Ingest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if reqData.FPS == 0 {
-		reqData.FPS = DefaultFPS
-	}
-
 	storageClient, err := storage.NewClient(ctx)
 	if err != nil {
 		sendError(w, fmt.Sprintf("Unable to create a storage client: %+v", err), http.StatusInternalServerError)
 		return
 	}
 
-	fileURL, err := url.Parse(reqData.File)
+	fStatus, err := startJob(ctx, client, storageClient, reqData)
 	if err != nil {
-		sendError(w, fmt.Sprintf("Unable to parse file url: %+v", err), http.StatusInternalServerError)
+		sendError(w, err.Error(), errorStatusCode(err))
 		return
 	}
 
+	if fStatus.Status != StatusProcessing {
+		// Recognized synchronously
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(fStatus)
+	}
+}
+
+// requestError is an error with the http status it should be reported with
+type requestError struct {
+	message string
+	code    int
+}
+
+func (e requestError) Error() string {
+	return e.message
+}
+
+// errorStatusCode returns the http status for an error returned by startJob
+func errorStatusCode(err error) int {
+	if e, ok := err.(requestError); ok {
+		return e.code
+	}
+	return http.StatusInternalServerError
+}
+
+// startJob validates the request and submits the file for transcription,
+// or recognizes it right away if it is short enough. The errors are requestErrors.
+func startJob(ctx context.Context, client *speech.Client, storageClient *storage.Client, reqData IngestRequest) (FileStatus, error) {
+	// Remote files are downloaded into the ingest bucket and processed from there
+	remoteFile := ""
+	if isRemoteSource(reqData.File) {
+		name, err := downloadName(reqData.File)
+		if err != nil {
+			return FileStatus{}, requestError{err.Error(), http.StatusBadRequest}
+		}
+		remoteFile = reqData.File
+		reqData.File = fmt.Sprintf("gs://%s/%s", ingestBucketID, name)
+	}
+
+	if err := reqData.Validate(); err != nil {
+		return FileStatus{}, requestError{err.Error(), http.StatusBadRequest}
+	}
+
+	if reqData.FPS == 0 {
+		reqData.FPS = DefaultFPS
+	}
+
+	if reqData.Channels == 0 {
+		reqData.Channels = 2
+	}
+
+	fileURL, err := url.Parse(reqData.File)
+	if err != nil {
+		return FileStatus{}, requestError{fmt.Sprintf("Unable to parse file url: %+v", err), http.StatusInternalServerError}
+	}
+
 	bucket := storageClient.Bucket(fileURL.Hostname())
 	statusFile := bucket.Object(fmt.Sprintf("status%s.json", fileURL.Path))
 
 	_, err = statusFile.Attrs(ctx)
 	if err != storage.ErrObjectNotExist {
-		sendError(w, fmt.Sprintf("File is already in progress: %+v", err), http.StatusConflict)
-		return
+		return FileStatus{}, requestError{fmt.Sprintf("File is already in progress: %+v", err), http.StatusConflict}
+	}
+
+	phrases, err := resolvePhrases(ctx, storageClient.Bucket(ingestBucketID), reqData)
+	if err != nil {
+		return FileStatus{}, requestError{fmt.Sprintf("Unable to load phrases: %+v", err), http.StatusBadRequest}
 	}
 
 	fStatus := FileStatus{
-		IngestRequest: reqData,
-		Status:        StatusProcessing,
-		SourceFile:    strings.TrimPrefix(fileURL.Path, "/"),
+		IngestRequest:  reqData,
+		SourceFile:     strings.TrimPrefix(fileURL.Path, "/"),
+		DownloadedFrom: remoteFile,
+		SpeechContexts: phrases,
+	}
+	if err := fStatus.setStatus(StatusProcessing, systemUser, ""); err != nil {
+		return fStatus, requestError{err.Error(), http.StatusInternalServerError}
+	}
+
+	generation, err := writeStatusGeneration(ctx, statusFile.If(storage.Conditions{DoesNotExist: true}), fStatus)
+	if err != nil {
+		return fStatus, requestError{fmt.Sprintf("Unable to write status file: %+v", err), http.StatusConflict}
+	}
+
+	// From now on the status is only changed if no one else, like Cancel, changed it
+	statusFile = statusFile.If(storage.Conditions{GenerationMatch: generation})
+
+	if remoteFile != "" {
+		err = fetchSource(ctx, remoteFile, reqData.Checksum, bucket.Object(fStatus.SourceFile))
+		if err != nil {
+			_ = statusFile.Delete(ctx)
+			return fStatus, requestError{fmt.Sprintf("Unable to download file: %v", err), http.StatusBadGateway}
+		}
+	}
+
+	// audio describes the file that is actually sent to the recognizer
+	audio := reqData
+	audio.Phrases = phrases
+	audio.Vocabularies = nil
+	audioObject := bucket.Object(fStatus.SourceFile)
+	resultBucket := storageClient.Bucket(resultBucketID)
+
+	// abort stops the chunks that were started and removes the status and the audio
+	// made for a job that could not be started. A status changed by someone else is kept.
+	abort := func() {
+		if err := cancelOperations(ctx, client, fStatus.operationNames()); err != nil {
+			log.Printf("Error cancelling operations of %s: %+v", fStatus.SourceFile, err)
+		}
+
+		_ = statusFile.Delete(ctx)
+		ingestBucket := storageClient.Bucket(ingestBucketID)
+		if fStatus.TranscodedFile != "" {
+			_ = ingestBucket.Object(fStatus.TranscodedFile).Delete(ctx)
+		}
+		deleteChunks(ctx, ingestBucket, fStatus.Chunks)
+	}
+
+	if !reqData.NoCache {
+		var cached []*speechpb.SpeechRecognitionResult
+		fStatus.CacheKey, cached, err = lookupCache(ctx, resultBucket, audioObject, audio)
+		if err != nil {
+			log.Printf("Not using the cache for %s: %+v", fStatus.SourceFile, err)
+		} else if cached != nil {
+			fStatus.Cached = true
+			if err := completeSync(ctx, resultBucket, bucket, statusFile, &fStatus, cached); err != nil {
+				return fStatus, err
+			}
+
+			log.Printf("Used the cached results for %s", fStatus.SourceFile)
+			return fStatus, nil
+		}
+	}
+
+	if reqData.ChunkMinutes > 0 {
+		chunkLen := time.Duration(reqData.ChunkMinutes) * time.Minute
+		fStatus.Chunks, err = splitAudio(ctx, bucket.Object(fStatus.SourceFile), storageClient.Bucket(ingestBucketID), chunkLen)
+		if err != nil {
+			_ = statusFile.Delete(ctx)
+			return fStatus, requestError{fmt.Sprintf("Unable to split file: %+v", err), http.StatusInternalServerError}
+		}
+	} else if reqData.NeedsTranscode() {
+		transcodedFile, err := transcode(ctx, bucket.Object(fStatus.SourceFile), storageClient.Bucket(ingestBucketID))
+		if err != nil {
+			_ = statusFile.Delete(ctx)
+			return fStatus, requestError{fmt.Sprintf("Unable to transcode file: %+v", err), http.StatusInternalServerError}
+		}
+
+		fStatus.TranscodedFile = transcodedFile
+		audio = audio.transcodedRequest(fmt.Sprintf("gs://%s/%s", ingestBucketID, transcodedFile))
+		audioObject = storageClient.Bucket(ingestBucketID).Object(transcodedFile)
+	}
+
+	if len(fStatus.Chunks) == 0 && isShortClip(ctx, audioObject) {
+		// Fast path: recognize and write the results right away
+		results, err := recognizeSync(ctx, client, audio)
+		if err != nil {
+			abort()
+			errorText, httpCode := startErrorResponse(err, reqData.File)
+			return fStatus, requestError{errorText, httpCode}
+		}
+
+		if err := completeSync(ctx, resultBucket, bucket, statusFile, &fStatus, results); err != nil {
+			abort()
+			return fStatus, err
+		}
+
+		if fStatus.CacheKey != "" {
+			if err := writeCache(ctx, resultBucket, fStatus.CacheKey, results); err != nil {
+				log.Printf("Error caching results of %s: %+v", fStatus.SourceFile, err)
+			}
+		}
+
+		log.Printf("Recognized %s synchronously", fStatus.SourceFile)
+		return fStatus, nil
+	}
+
+	if reason := queueReason(ctx, storageClient.Bucket(ingestBucketID), fStatus); reason != "" {
+		err = fStatus.queueJob(reason)
+	} else if err = fStatus.submit(ctx, client); isQuotaError(err) {
+		err = fStatus.queueJob("Waiting for the speech API quota")
+	}
+	if err != nil {
+		abort()
+		errorText, httpCode := startErrorResponse(err, reqData.File)
+		return fStatus, requestError{errorText, httpCode}
 	}
 
 	err = writeStatus(ctx, statusFile, fStatus)
+	if isConflict(err) {
+		// Cancelled while the job was started. The status is kept, as its generation changed.
+		statusChanged(ctx, client, bucket, fStatus, nil)
+		abort()
+		return fStatus, requestError{"The job was changed by someone else while it was started", http.StatusConflict}
+	} else if err != nil {
+		abort()
+		return fStatus, requestError{fmt.Sprintf("Unable to write status file: %+v", err), http.StatusInternalServerError}
+	}
+
+	if fStatus.Status == StatusQueued {
+		log.Printf("Queued %s: %s", fStatus.SourceFile, fStatus.History[len(fStatus.History)-1].Comment)
+	} else if len(fStatus.Chunks) > 0 {
+		log.Printf("Started %d chunks for %s", len(fStatus.Chunks), fStatus.SourceFile)
+	} else {
+		log.Printf("Op id: %s", fStatus.JobID)
+	}
+
+	return fStatus, nil
+}
+
+// completeSync writes the outputs of a job that is done without an operation and completes it
+func completeSync(ctx context.Context, resultBucket, bucket *storage.BucketHandle, statusFile *storage.ObjectHandle, fStatus *FileStatus, results []*speechpb.SpeechRecognitionResult) error {
+	err := writeOutputs(ctx, resultBucket, fStatus, fStatus.withScript(results))
 	if err != nil {
-		sendError(w, fmt.Sprintf("Unable to write status file: %+v", err), http.StatusConflict)
-		return
+		_ = statusFile.Delete(ctx)
+		return requestError{fmt.Sprintf("Unable to write results: %+v", err), http.StatusInternalServerError}
 	}
 
-	// Send the contents of the audio file with the encoding and
-	// and sample rate information to be transcripted.
-	req := &speechpb.LongRunningRecognizeRequest{
-		Config: &speechpb.RecognitionConfig{
-			Encoding:                   reqData.Encoding(),
-			SampleRateHertz:            reqData.SampleRateHertz,
-			AudioChannelCount:          2,
-			LanguageCode:               reqData.Language,
-			SpeechContexts:             []*speechpb.SpeechContext{},
-			EnableAutomaticPunctuation: true,
-			EnableWordTimeOffsets:      true,
-			Metadata: &speechpb.RecognitionMetadata{
-				InteractionType:     speechpb.RecognitionMetadata_PRESENTATION,
-				MicrophoneDistance:  speechpb.RecognitionMetadata_MIDFIELD,
-				OriginalMediaType:   speechpb.RecognitionMetadata_AUDIO,
-				RecordingDeviceType: speechpb.RecognitionMetadata_OTHER_INDOOR_DEVICE,
-			},
-		},
+	if err := fStatus.setStatus(completedStatus(*fStatus), systemUser, ""); err != nil {
+		_ = statusFile.Delete(ctx)
+		return requestError{err.Error(), http.StatusInternalServerError}
+	}
+
+	generation, err := writeStatusGeneration(ctx, statusFile, *fStatus)
+	if isConflict(err) {
+		return requestError{"The job was changed by someone else while it was started", http.StatusConflict}
+	} else if err != nil {
+		return requestError{fmt.Sprintf("Unable to write status file: %+v", err), http.StatusInternalServerError}
+	}
+
+	deleteSourceFiles(ctx, bucket, *fStatus)
+	renameStatus(ctx, bucket, bucket.Object(statusFile.ObjectName()).If(storage.Conditions{GenerationMatch: generation}), "done")
+	return nil
+}
+
+// longRunningRequest describes the audio file with the encoding and
+// and sample rate information to be transcripted.
+func longRunningRequest(audio IngestRequest) *speechpb.LongRunningRecognizeRequest {
+	return &speechpb.LongRunningRecognizeRequest{
+		Config: recognitionConfig(audio),
 		Audio: &speechpb.RecognitionAudio{
-			AudioSource: &speechpb.RecognitionAudio_Uri{Uri: reqData.File},
+			AudioSource: &speechpb.RecognitionAudio_Uri{Uri: audio.File},
 		},
 	}
+}
 
-	op, err := client.LongRunningRecognize(ctx, req)
+// startRecognition submits the audio for transcription and returns the id of the operation
+func startRecognition(ctx context.Context, client *speech.Client, audio IngestRequest) (string, error) {
+	op, err := client.LongRunningRecognize(ctx, longRunningRequest(audio))
 	if err != nil {
-		errStatus, ok := status.FromError(err)
-
-		errorText := fmt.Sprintf("Error starting job: %+v", err)
-		httpCode := http.StatusInternalServerError
-
-		if !ok {
-			errorText = fmt.Sprintf("Error starting job - Unknown error: %+v", err)
-		} else if errStatus.Code() == codes.NotFound {
-			errorText = fmt.Sprintf("Could not locate file \"%s\"", reqData.File)
-			httpCode = http.StatusNotFound
-		} else if errStatus.Code() == codes.InvalidArgument {
-			errorText = fmt.Sprintf("Illegal argumet: \"%s\"", errStatus.Message())
-			httpCode = http.StatusBadRequest
-		}
+		return "", err
+	}
+
+	return op.Name(), nil
+}
 
-		sendError(w, errorText, httpCode)
+// startErrorResponse converts an error from the speech API into a message and http status
+func startErrorResponse(err error, file string) (string, int) {
+	errStatus, ok := status.FromError(err)
 
-		_ = statusFile.Delete(ctx)
-		return
+	errorText := fmt.Sprintf("Error starting job: %+v", err)
+	httpCode := http.StatusInternalServerError
+
+	if !ok {
+		errorText = fmt.Sprintf("Error starting job - Unknown error: %+v", err)
+	} else if errStatus.Code() == codes.NotFound {
+		errorText = fmt.Sprintf("Could not locate file \"%s\"", file)
+		httpCode = http.StatusNotFound
+	} else if errStatus.Code() == codes.InvalidArgument {
+		errorText = fmt.Sprintf("Illegal argumet: \"%s\"", errStatus.Message())
+		httpCode = http.StatusBadRequest
 	}
 
-	fStatus.JobID = op.Name()
+	return errorText, httpCode
+}
 
-	err = writeStatus(ctx, statusFile, fStatus)
+// pollResults returns the results and the progress of an operation. done is false if it is still running
+func pollResults(ctx context.Context, client *speech.Client, jobID string) ([]*speechpb.SpeechRecognitionResult, bool, *Progress, error) {
+	op := client.LongRunningRecognizeOperation(jobID)
+	resp, err := op.Poll(ctx)
 	if err != nil {
-		sendError(w, fmt.Sprintf("Unable to write status file: %+v", err), http.StatusConflict)
-		return
+		return nil, op.Done(), nil, err
+	}
+
+	md, err := op.Metadata()
+	if err != nil {
+		log.Printf("Can't read metadata of %s: %+v", jobID, err)
+	}
+	progress := progressFromMetadata(md, op.Done())
+
+	if !op.Done() {
+		return nil, false, progress, nil
+	}
+
+	results := []*speechpb.SpeechRecognitionResult{}
+	for _, r := range resp.GetResults() {
+		results = append(results, r)
 	}
-	log.Printf("Op id: %s", op.Name())
+
+	return results, true, progress, nil
 }
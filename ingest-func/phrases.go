@@ -0,0 +1,156 @@
+package stt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"cloud.google.com/go/storage"
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1p1beta1"
+)
+
+// Limits for phrase hints, see https://cloud.google.com/speech-to-text/quotas#content
+const (
+	MaxPhrases          = 5000
+	MaxPhraseLength     = 100
+	MaxPhraseCharacters = 100000
+	MaxBoost            = 20
+)
+
+// vocabulariesPrefix is where named vocabularies are stored in the ingest bucket
+const vocabulariesPrefix = "vocabularies/"
+
+var vocabularyNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// PhraseSet is a list of phrase hints sharing the same boost
+type PhraseSet struct {
+	Phrases []string `json:"phrases"`
+	Boost   float32  `json:"boost,omitempty"`
+}
+
+// validatePhrases checks the phrase sets against the limits of the recognizer
+func validatePhrases(sets []PhraseSet) error {
+	count := 0
+	chars := 0
+	for _, set := range sets {
+		if set.Boost < 0 || set.Boost > MaxBoost {
+			return fmt.Errorf("Boost must be between 0 and %d, got %g", MaxBoost, set.Boost)
+		}
+
+		for _, p := range set.Phrases {
+			l := utf8.RuneCountInString(p)
+			if l > MaxPhraseLength {
+				return fmt.Errorf("Phrase \"%s\" is longer than %d characters", p, MaxPhraseLength)
+			}
+
+			count++
+			chars += l
+		}
+	}
+
+	if count > MaxPhrases {
+		return fmt.Errorf("Too many phrases: %d, the limit is %d", count, MaxPhrases)
+	}
+
+	if chars > MaxPhraseCharacters {
+		return fmt.Errorf("Too many characters in phrases: %d, the limit is %d", chars, MaxPhraseCharacters)
+	}
+
+	return nil
+}
+
+func (r IngestRequest) validatePhrases() error {
+	for _, name := range r.Vocabularies {
+		if !vocabularyNameRegexp.MatchString(name) {
+			return fmt.Errorf("Invalid vocabulary name: \"%s\"", name)
+		}
+	}
+
+	return validatePhrases(r.Phrases)
+}
+
+// mergePhrases combines the sets with the same boost and removes duplicate and empty phrases
+func mergePhrases(sets ...[]PhraseSet) []PhraseSet {
+	merged := []PhraseSet{}
+	byBoost := map[float32]int{}
+	seen := map[float32]map[string]bool{}
+
+	for _, list := range sets {
+		for _, set := range list {
+			for _, p := range set.Phrases {
+				p = strings.TrimSpace(p)
+				if p == "" || seen[set.Boost][p] {
+					continue
+				}
+
+				i, ok := byBoost[set.Boost]
+				if !ok {
+					i = len(merged)
+					byBoost[set.Boost] = i
+					seen[set.Boost] = map[string]bool{}
+					merged = append(merged, PhraseSet{Boost: set.Boost})
+				}
+
+				merged[i].Phrases = append(merged[i].Phrases, p)
+				seen[set.Boost][p] = true
+			}
+		}
+	}
+
+	return merged
+}
+
+// readVocabulary loads a named vocabulary from the ingest bucket
+func readVocabulary(ctx context.Context, ingestBucket *storage.BucketHandle, name string) ([]PhraseSet, error) {
+	reader, err := ingestBucket.Object(fmt.Sprintf("%s%s.json", vocabulariesPrefix, name)).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, fmt.Errorf("Vocabulary \"%s\" does not exist", name)
+	} else if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	sets := []PhraseSet{}
+	if err := json.Unmarshal(data, &sets); err != nil {
+		return nil, fmt.Errorf("Vocabulary \"%s\" is not valid: %v", name, err)
+	}
+
+	return sets, nil
+}
+
+// resolvePhrases merges the phrases of the request with the referenced vocabularies
+func resolvePhrases(ctx context.Context, ingestBucket *storage.BucketHandle, r IngestRequest) ([]PhraseSet, error) {
+	sets := [][]PhraseSet{r.Phrases}
+	for _, name := range r.Vocabularies {
+		vocabulary, err := readVocabulary(ctx, ingestBucket, name)
+		if err != nil {
+			return nil, err
+		}
+
+		sets = append(sets, vocabulary)
+	}
+
+	merged := mergePhrases(sets...)
+	return merged, validatePhrases(merged)
+}
+
+func speechContexts(sets []PhraseSet) []*speechpb.SpeechContext {
+	contexts := []*speechpb.SpeechContext{}
+	for _, set := range sets {
+		contexts = append(contexts, &speechpb.SpeechContext{
+			Phrases: set.Phrases,
+			Boost:   set.Boost,
+		})
+	}
+
+	return contexts
+}
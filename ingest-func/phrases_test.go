@@ -0,0 +1,29 @@
+package stt
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_mergePhrases(t *testing.T) {
+	request := []PhraseSet{{Phrases: []string{"Brunstad", "Samvirk "}, Boost: 10}}
+	vocabulary := []PhraseSet{
+		{Phrases: []string{"Samvirk", "BCC"}, Boost: 10},
+		{Phrases: []string{"Oslo", ""}},
+	}
+
+	assert.Equal(t, []PhraseSet{
+		{Phrases: []string{"Brunstad", "Samvirk", "BCC"}, Boost: 10},
+		{Phrases: []string{"Oslo"}},
+	}, mergePhrases(request, vocabulary))
+}
+
+func Test_validatePhrases(t *testing.T) {
+	assert.NoError(t, validatePhrases([]PhraseSet{{Phrases: []string{"Brunstad"}, Boost: 20}}))
+	assert.Error(t, validatePhrases([]PhraseSet{{Phrases: []string{"Brunstad"}, Boost: 21}}))
+	assert.Error(t, validatePhrases([]PhraseSet{{Phrases: []string{strings.Repeat("a", MaxPhraseLength+1)}}}))
+
+	assert.Error(t, IngestRequest{File: "gs://b/a.flac", Vocabularies: []string{"../secret"}}.Validate())
+}
@@ -0,0 +1,96 @@
+package stt
+
+import (
+	"time"
+
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1p1beta1"
+)
+
+// Progress of the recognition of a job, as reported by the speech API
+type Progress struct {
+	Percent        int32      `json:"percent"`
+	StartTime      time.Time  `json:"start_time"`
+	LastUpdateTime time.Time  `json:"last_update_time"`
+	ETA            *time.Time `json:"eta,omitempty"`
+}
+
+// progressFromMetadata converts the metadata of an operation, which can be nil
+func progressFromMetadata(md *speechpb.LongRunningRecognizeMetadata, done bool) *Progress {
+	if md == nil && !done {
+		return nil
+	}
+
+	p := &Progress{Percent: md.GetProgressPercent()}
+	if md.GetStartTime() != nil {
+		p.StartTime = md.GetStartTime().AsTime()
+	}
+	if md.GetLastUpdateTime() != nil {
+		p.LastUpdateTime = md.GetLastUpdateTime().AsTime()
+	}
+	if done {
+		p.Percent = 100
+	}
+	return p
+}
+
+// combineProgress sums up the progress of the chunks of a job.
+// Chunks without progress count as not started, and there is no progress until one has some.
+func combineProgress(chunks []*Progress) *Progress {
+	var combined *Progress
+	var percent int32
+	for _, p := range chunks {
+		if p == nil {
+			continue
+		}
+		if combined == nil {
+			combined = &Progress{}
+		}
+
+		percent += p.Percent
+		if !p.StartTime.IsZero() && (combined.StartTime.IsZero() || p.StartTime.Before(combined.StartTime)) {
+			combined.StartTime = p.StartTime
+		}
+		if p.LastUpdateTime.After(combined.LastUpdateTime) {
+			combined.LastUpdateTime = p.LastUpdateTime
+		}
+	}
+
+	if combined == nil {
+		return nil
+	}
+	combined.Percent = percent / int32(len(chunks))
+	return combined
+}
+
+// withETA estimates when the recognition is done, assuming it keeps the speed it had so far
+func (p *Progress) withETA() *Progress {
+	if p == nil {
+		return nil
+	}
+
+	p.ETA = nil
+	if p.Percent <= 0 || p.Percent >= 100 || p.StartTime.IsZero() || !p.LastUpdateTime.After(p.StartTime) {
+		return p
+	}
+
+	elapsed := p.LastUpdateTime.Sub(p.StartTime)
+	eta := p.StartTime.Add(elapsed * 100 / time.Duration(p.Percent))
+	p.ETA = &eta
+	return p
+}
+
+// changed is true if p has news compared to the progress stored before
+func (p *Progress) changed(before *Progress) bool {
+	if p == nil {
+		return false
+	}
+	return before == nil || p.Percent != before.Percent || !p.LastUpdateTime.Equal(before.LastUpdateTime)
+}
+
+// percent is 0 if there is no progress yet
+func (p *Progress) percent() int32 {
+	if p == nil {
+		return 0
+	}
+	return p.Percent
+}
@@ -0,0 +1,64 @@
+package stt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1p1beta1"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func Test_progressFromMetadata(t *testing.T) {
+	start := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	md := &speechpb.LongRunningRecognizeMetadata{
+		ProgressPercent: 40,
+		StartTime:       timestamppb.New(start),
+		LastUpdateTime:  timestamppb.New(start.Add(4 * time.Minute)),
+	}
+
+	p := progressFromMetadata(md, false)
+	assert.Equal(t, int32(40), p.Percent)
+	assert.Equal(t, start, p.StartTime)
+	assert.Equal(t, start.Add(4*time.Minute), p.LastUpdateTime)
+
+	assert.Equal(t, int32(100), progressFromMetadata(md, true).Percent)
+	assert.Nil(t, progressFromMetadata(nil, false))
+	assert.Equal(t, int32(100), progressFromMetadata(nil, true).Percent)
+}
+
+func Test_withETA(t *testing.T) {
+	start := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	p := (&Progress{Percent: 40, StartTime: start, LastUpdateTime: start.Add(4 * time.Minute)}).withETA()
+	assert.Equal(t, start.Add(10*time.Minute), *p.ETA)
+
+	assert.Nil(t, (&Progress{Percent: 0, StartTime: start, LastUpdateTime: start}).withETA().ETA)
+	assert.Nil(t, (&Progress{Percent: 100, StartTime: start, LastUpdateTime: start.Add(time.Minute)}).withETA().ETA)
+	assert.Nil(t, (*Progress)(nil).withETA())
+}
+
+func Test_combineProgress(t *testing.T) {
+	start := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	p := combineProgress([]*Progress{
+		{Percent: 100, StartTime: start.Add(time.Minute), LastUpdateTime: start.Add(5 * time.Minute)},
+		{Percent: 50, StartTime: start, LastUpdateTime: start.Add(3 * time.Minute)},
+		nil,
+	})
+
+	assert.Equal(t, int32(50), p.Percent)
+	assert.Equal(t, start, p.StartTime)
+	assert.Equal(t, start.Add(5*time.Minute), p.LastUpdateTime)
+	assert.Nil(t, combineProgress(nil))
+	assert.Nil(t, combineProgress([]*Progress{nil, nil}))
+}
+
+func Test_progressChanged(t *testing.T) {
+	at := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	p := &Progress{Percent: 10, LastUpdateTime: at}
+
+	assert.True(t, p.changed(nil))
+	assert.False(t, p.changed(&Progress{Percent: 10, LastUpdateTime: at}))
+	assert.True(t, p.changed(&Progress{Percent: 5, LastUpdateTime: at}))
+	assert.False(t, (*Progress)(nil).changed(p))
+	assert.Equal(t, int32(0), (*Progress)(nil).percent())
+}
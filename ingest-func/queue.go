@@ -0,0 +1,293 @@
+package stt
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	speech "cloud.google.com/go/speech/apiv1p1beta1"
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxInFlight limits the number of speech operations running at the same time, 0 means no limit.
+// Jobs over the limit are queued and started by ProcessResults when operations finish.
+var maxInFlight = parseMaxInFlight(envOrDefault("MAX_IN_FLIGHT", "0"))
+
+func parseMaxInFlight(s string) int {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		log.Printf("Invalid MAX_IN_FLIGHT \"%s\", no limit is used", s)
+		return 0
+	}
+	return n
+}
+
+// isQuotaError is true if the speech API refused an operation because too many are running
+func isQuotaError(err error) bool {
+	return status.Code(err) == codes.ResourceExhausted
+}
+
+// startedOperations is the number of speech operations the job has started
+func (s FileStatus) startedOperations() int {
+	return len(s.operationNames())
+}
+
+// operationsSince returns the operations of the job that are not in before
+func (s FileStatus) operationsSince(before []string) []string {
+	known := map[string]bool{}
+	for _, name := range before {
+		known[name] = true
+	}
+
+	names := []string{}
+	for _, name := range s.operationNames() {
+		if !known[name] {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// pendingOperations is the number of speech operations the job still has to start
+func (s FileStatus) pendingOperations() int {
+	if len(s.Chunks) == 0 {
+		if s.JobID == "" {
+			return 1
+		}
+		return 0
+	}
+	return len(s.Chunks) - s.startedOperations()
+}
+
+// queuedAt is when the job was queued the last time
+func (s FileStatus) queuedAt() time.Time {
+	for i := len(s.History) - 1; i >= 0; i-- {
+		if s.History[i].To == StatusQueued {
+			return s.History[i].At
+		}
+	}
+	return time.Time{}
+}
+
+// queueMetadata is stored on the status file, so the queue can be read from a listing of the status files
+func (s FileStatus) queueMetadata() map[string]string {
+	metadata := map[string]string{
+		"status":     s.Status,
+		"operations": strconv.Itoa(s.startedOperations()),
+		"priority":   strconv.Itoa(int(s.Priority)),
+	}
+	if s.Status == StatusQueued {
+		metadata["queued_at"] = s.queuedAt().Format(time.RFC3339Nano)
+	}
+	return metadata
+}
+
+// submit starts the speech operations of the job that are not started yet
+func (s *FileStatus) submit(ctx context.Context, client *speech.Client) error {
+	s.SubmittedAt = time.Now().UTC()
+	if len(s.Chunks) > 0 {
+		return startChunks(ctx, client, s.audioRequest(), s.Chunks)
+	}
+
+	jobID, err := startRecognition(ctx, client, s.audioRequest())
+	if err != nil {
+		return err
+	}
+	s.JobID = jobID
+	return nil
+}
+
+// queuedJob is a queued status file
+type queuedJob struct {
+	name       string
+	generation int64
+	priority   int
+	queuedAt   time.Time
+}
+
+// queueState counts the running operations of the status files and lists the queued jobs
+// in the order they are started: highest priority first, then first queued first
+func queueState(objs []*storage.ObjectAttrs) (int, []queuedJob) {
+	inFlight := 0
+	queued := []queuedJob{}
+	for _, attrs := range objs {
+		if !strings.HasSuffix(attrs.Name, ".json") {
+			// Finished jobs
+			continue
+		}
+
+		switch attrs.Metadata["status"] {
+		case StatusQueued:
+			job := queuedJob{name: attrs.Name, generation: attrs.Generation}
+			job.priority, _ = strconv.Atoi(attrs.Metadata["priority"])
+			job.queuedAt, _ = time.Parse(time.RFC3339Nano, attrs.Metadata["queued_at"])
+			queued = append(queued, job)
+			inFlight += atoiOrZero(attrs.Metadata["operations"])
+		case "":
+			// Written before the queue, assume it is running
+			inFlight++
+		default:
+			inFlight += atoiOrZero(attrs.Metadata["operations"])
+		}
+	}
+
+	sort.SliceStable(queued, func(i, j int) bool {
+		if queued[i].priority != queued[j].priority {
+			return queued[i].priority > queued[j].priority
+		}
+		return queued[i].queuedAt.Before(queued[j].queuedAt)
+	})
+
+	return inFlight, queued
+}
+
+func atoiOrZero(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+// readQueue lists the status files of the bucket, see queueState
+func readQueue(ctx context.Context, bucket *storage.BucketHandle) (int, []queuedJob, error) {
+	objs := []*storage.ObjectAttrs{}
+	it := bucket.Objects(ctx, &storage.Query{Prefix: "status/"})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return 0, nil, err
+		}
+		objs = append(objs, attrs)
+	}
+
+	inFlight, queued := queueState(objs)
+	return inFlight, queued, nil
+}
+
+// hasSlots is true if more operations can be started. A job that needs more
+// operations than the limit is started when nothing else is running.
+func hasSlots(inFlight, operations int) bool {
+	return maxInFlight == 0 || inFlight == 0 || inFlight+operations <= maxInFlight
+}
+
+// startQueued starts the queued jobs of the bucket while there are free slots
+func startQueued(ctx context.Context, client *speech.Client, bucket *storage.BucketHandle) {
+	inFlight, queued, err := readQueue(ctx, bucket)
+	if err != nil {
+		log.Printf("Can't read the queue: %+v", err)
+		return
+	}
+
+	for _, job := range queued {
+		if maxInFlight > 0 && inFlight >= maxInFlight {
+			return
+		}
+
+		statusFile := bucket.Object(job.name).If(storage.Conditions{GenerationMatch: job.generation})
+		reader, err := statusFile.NewReader(ctx)
+		if err != nil {
+			// Changed or removed since it was listed
+			log.Printf("Can't open queued status file %s: %+v", job.name, err)
+			continue
+		}
+
+		data, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			log.Printf("Can't read queued status file %s: %+v", job.name, err)
+			continue
+		}
+
+		fileStatus, err := decodeStatus(data)
+		if err != nil || fileStatus.Status != StatusQueued {
+			continue
+		}
+
+		operations := fileStatus.pendingOperations()
+		if !hasSlots(inFlight, operations) {
+			// Keep the order of the queue
+			return
+		}
+
+		started := fileStatus.operationNames()
+		if err := fileStatus.setStatus(StatusProcessing, systemUser, "Started from the queue"); err != nil {
+			log.Printf("Can't start queued %s: %+v", fileStatus.SourceFile, err)
+			continue
+		}
+
+		err = fileStatus.submit(ctx, client)
+		if isQuotaError(err) {
+			log.Printf("Quota reached starting %s, it stays queued", fileStatus.SourceFile)
+			if len(fileStatus.operationsSince(started)) > 0 {
+				// Keep the chunks that were started
+				fileStatus.queueJob("Waiting for the speech API quota")
+				if err := writeStatus(ctx, statusFile, fileStatus); isConflict(err) {
+					statusChanged(ctx, client, bucket, fileStatus, fileStatus.operationsSince(started))
+				} else if err != nil {
+					log.Printf("Can't write status of %s, cancelling its operations: %+v", fileStatus.SourceFile, err)
+					cancelOperations(ctx, client, fileStatus.operationsSince(started))
+				}
+			}
+			return
+		} else if err != nil {
+			log.Printf("Can't start queued %s: %+v", fileStatus.SourceFile, err)
+			cancelOperations(ctx, client, fileStatus.operationNames())
+			fileStatus.fail(err)
+		}
+
+		err = writeStatus(ctx, statusFile, fileStatus)
+		if isConflict(err) {
+			statusChanged(ctx, client, bucket, fileStatus, fileStatus.operationsSince(started))
+			continue
+		} else if err != nil {
+			log.Printf("Can't write status of %s, cancelling its operations: %+v", fileStatus.SourceFile, err)
+			cancelOperations(ctx, client, fileStatus.operationsSince(started))
+			continue
+		}
+
+		inFlight += len(fileStatus.operationsSince(started))
+		log.Printf("Started queued %s with priority %d", fileStatus.SourceFile, fileStatus.Priority)
+	}
+}
+
+// queueJob marks a job as waiting for a free slot
+func (s *FileStatus) queueJob(reason string) error {
+	return s.setStatus(StatusQueued, systemUser, reason)
+}
+
+// queueReason returns why a job has to wait before it can be submitted, or "" if it can be submitted now
+func queueReason(ctx context.Context, ingestBucket *storage.BucketHandle, s FileStatus) string {
+	if maxInFlight == 0 {
+		return ""
+	}
+
+	inFlight, queued, err := readQueue(ctx, ingestBucket)
+	if err != nil {
+		log.Printf("Can't read the queue, starting %s: %+v", s.SourceFile, err)
+		return ""
+	}
+
+	ahead := 0
+	for _, job := range queued {
+		if job.priority >= int(s.Priority) {
+			ahead++
+		}
+	}
+	if ahead > 0 {
+		return fmt.Sprintf("%d jobs with the same or higher priority are waiting", ahead)
+	}
+
+	if !hasSlots(inFlight, s.pendingOperations()) {
+		return fmt.Sprintf("%d of %d operations are running", inFlight, maxInFlight)
+	}
+
+	return ""
+}
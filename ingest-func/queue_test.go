@@ -0,0 +1,104 @@
+package stt
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseMaxInFlight(t *testing.T) {
+	assert.Equal(t, 0, parseMaxInFlight("0"))
+	assert.Equal(t, 20, parseMaxInFlight("20"))
+	assert.Equal(t, 0, parseMaxInFlight("-2"))
+}
+
+func Test_pendingOperations(t *testing.T) {
+	assert.Equal(t, 1, FileStatus{}.pendingOperations())
+	assert.Equal(t, 0, FileStatus{JobID: "op"}.pendingOperations())
+
+	s := FileStatus{Chunks: []Chunk{{JobID: "a"}, {}, {}}}
+	assert.Equal(t, 2, s.pendingOperations())
+	assert.Equal(t, 1, s.startedOperations())
+}
+
+func Test_queueMetadata(t *testing.T) {
+	at := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	s := FileStatus{
+		IngestRequest: IngestRequest{Priority: 5},
+		Status:        StatusQueued,
+		Chunks:        []Chunk{{JobID: "a"}, {}},
+		History:       []StatusChange{{To: StatusProcessing}, {To: StatusQueued, At: at}},
+	}
+
+	assert.Equal(t, map[string]string{
+		"status":     StatusQueued,
+		"operations": "1",
+		"priority":   "5",
+		"queued_at":  "2021-01-01T12:00:00Z",
+	}, s.queueMetadata())
+}
+
+func Test_queueState(t *testing.T) {
+	queued := func(name, priority, at string) *storage.ObjectAttrs {
+		return &storage.ObjectAttrs{Name: name, Metadata: map[string]string{
+			"status": StatusQueued, "priority": priority, "queued_at": at, "operations": "0",
+		}}
+	}
+
+	inFlight, jobs := queueState([]*storage.ObjectAttrs{
+		{Name: "status/a.json", Metadata: map[string]string{"status": StatusProcessing, "operations": "3"}},
+		{Name: "status/b.json"},
+		{Name: "status/c.json.done", Metadata: map[string]string{"status": StatusProcessing, "operations": "3"}},
+		queued("status/late.json", "0", "2021-01-01T12:05:00Z"),
+		queued("status/early.json", "0", "2021-01-01T12:00:00Z"),
+		queued("status/urgent.json", "10", "2021-01-01T12:10:00Z"),
+	})
+
+	assert.Equal(t, 4, inFlight)
+	names := []string{}
+	for _, j := range jobs {
+		names = append(names, j.name)
+	}
+	assert.Equal(t, []string{"status/urgent.json", "status/early.json", "status/late.json"}, names)
+}
+
+func Test_hasSlots(t *testing.T) {
+	limit := maxInFlight
+	defer func() { maxInFlight = limit }()
+
+	maxInFlight = 0
+	assert.True(t, hasSlots(100, 10))
+
+	maxInFlight = 5
+	assert.True(t, hasSlots(3, 2))
+	assert.False(t, hasSlots(3, 3))
+	// Jobs with more chunks than the limit can still run alone
+	assert.True(t, hasSlots(0, 8))
+}
+
+func Test_operationsSince(t *testing.T) {
+	s := FileStatus{Chunks: []Chunk{{JobID: "a"}, {JobID: "b"}, {JobID: "c"}}}
+	assert.Equal(t, []string{"c"}, s.operationsSince([]string{"a", "b"}))
+	assert.Len(t, s.operationsSince(s.operationNames()), 0)
+}
+
+func Test_startQueued_cancelledWhileStarting(t *testing.T) {
+	defer useTestBuckets()()
+	storageClient, fakeStorage := newFakeStorage(t)
+	client, fakeSpeech, stop := newFakeSpeech(t)
+	defer stop()
+
+	s := FileStatus{IngestRequest: IngestRequest{File: "gs://ingest/a.flac", Language: "no-NO", FPS: DefaultFPS}, SourceFile: "a.flac"}
+	assert.NoError(t, s.queueJob("Waiting"))
+	fakeStorage.putStatus(t, "ingest", "status/a.flac.json", s)
+	fakeSpeech.onStart = func() { cancelInFake(t, fakeStorage, "status/a.flac.json") }
+
+	startQueued(context.Background(), client, storageClient.Bucket("ingest"))
+
+	assert.Equal(t, []string{"op1"}, fakeSpeech.cancelled)
+	assert.Nil(t, fakeStorage.get("ingest", "status/a.flac.json"))
+	assert.Equal(t, StatusCancelled, fakeStorage.getStatus(t, "ingest", "status/a.flac.json.done").Status)
+}
@@ -0,0 +1,116 @@
+package stt
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	speech "cloud.google.com/go/speech/apiv1p1beta1"
+	"google.golang.org/protobuf/proto"
+)
+
+// Recognizer transcribes the audio described by a validated request.
+// It is used to run the same requests against the recognizer or recorded responses.
+type Recognizer interface {
+	Recognize(ctx context.Context, audio IngestRequest) (Transcript, error)
+}
+
+// SpeechRecognizer uses the speech API and waits for the result
+type SpeechRecognizer struct {
+	Client *speech.Client
+}
+
+// Recognize implements Recognizer
+func (r SpeechRecognizer) Recognize(ctx context.Context, audio IngestRequest) (Transcript, error) {
+	op, err := r.Client.LongRunningRecognize(ctx, longRunningRequest(audio))
+	if err != nil {
+		return Transcript{}, err
+	}
+
+	resp, err := op.Wait(ctx)
+	if err != nil {
+		return Transcript{}, err
+	}
+
+	return transcriptFromResults(resp.GetResults(), audio.Language), nil
+}
+
+// requestHash identifies the audio and the recognition settings of a request
+func requestHash(audio IngestRequest) (string, error) {
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(longRunningRequest(audio))
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func recordingPath(dir string, audio IngestRequest) (string, error) {
+	hash, err := requestHash(audio)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, fmt.Sprintf("%s.json", hash)), nil
+}
+
+// RecordingRecognizer stores the transcripts of another Recognizer in Dir, so they can be replayed
+type RecordingRecognizer struct {
+	Recognizer Recognizer
+	Dir        string
+}
+
+// Recognize implements Recognizer
+func (r RecordingRecognizer) Recognize(ctx context.Context, audio IngestRequest) (Transcript, error) {
+	transcript, err := r.Recognizer.Recognize(ctx, audio)
+	if err != nil {
+		return transcript, err
+	}
+
+	path, err := recordingPath(r.Dir, audio)
+	if err != nil {
+		return transcript, err
+	}
+
+	data, err := json.Marshal(transcript)
+	if err != nil {
+		return transcript, err
+	}
+
+	if err := os.MkdirAll(r.Dir, 0755); err != nil {
+		return transcript, err
+	}
+
+	return transcript, ioutil.WriteFile(path, data, 0644)
+}
+
+// ReplayRecognizer returns the transcripts stored by a RecordingRecognizer.
+// The request must have the same audio and recognition settings as the recorded one.
+type ReplayRecognizer struct {
+	Dir string
+}
+
+// Recognize implements Recognizer
+func (r ReplayRecognizer) Recognize(ctx context.Context, audio IngestRequest) (Transcript, error) {
+	transcript := Transcript{}
+
+	path, err := recordingPath(r.Dir, audio)
+	if err != nil {
+		return transcript, err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return transcript, fmt.Errorf("No recording of %s with these settings", audio.File)
+	} else if err != nil {
+		return transcript, err
+	}
+
+	err = json.Unmarshal(data, &transcript)
+	return transcript, err
+}
@@ -0,0 +1,335 @@
+package stt
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// downloadsPrefix is where files from other sources are stored in the ingest bucket
+const downloadsPrefix = "downloads/"
+
+// DefaultMaxDownloadSize limits the size of files downloaded from other sources, 5 GB
+const DefaultMaxDownloadSize = 5 << 30
+
+var (
+	maxDownloadSize = parseMaxDownloadSize(os.Getenv("MAX_DOWNLOAD_SIZE"))
+
+	s3Region   = envOrDefault("AWS_REGION", "us-east-1")
+	s3Endpoint = os.Getenv("S3_ENDPOINT")
+)
+
+// emptyPayloadHash is the SHA-256 of an empty body, as sent to S3 for downloads
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func parseMaxDownloadSize(s string) int64 {
+	if s == "" {
+		return DefaultMaxDownloadSize
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return DefaultMaxDownloadSize
+	}
+	return n
+}
+
+// isRemoteSource is true for files that have to be downloaded into the ingest bucket first
+func isRemoteSource(file string) bool {
+	u, err := url.Parse(file)
+	if err != nil {
+		return false
+	}
+	return u.Scheme == "http" || u.Scheme == "https" || u.Scheme == "s3"
+}
+
+// downloadName is where a remote file is stored in the ingest bucket. The query is not part of it.
+func downloadName(file string) (string, error) {
+	u, err := url.Parse(file)
+	if err != nil {
+		return "", err
+	}
+
+	p := strings.TrimPrefix(u.Path, "/")
+	if p == "" {
+		return "", fmt.Errorf("Url \"%s\" has no file name", file)
+	}
+	return fmt.Sprintf("%s%s/%s", downloadsPrefix, u.Host, p), nil
+}
+
+// checksum verifies the data written to it against an expected digest
+type checksum struct {
+	name     string
+	hash     hash.Hash
+	expected []byte
+}
+
+func (c checksum) verify() error {
+	if actual := c.hash.Sum(nil); !bytes.Equal(actual, c.expected) {
+		return fmt.Errorf("Checksum mismatch: %s is %x, expected %x", c.name, actual, c.expected)
+	}
+	return nil
+}
+
+// parseChecksum reads a checksum like "sha256:<hex>". md5, sha1 and sha256 are supported.
+func parseChecksum(s string) (checksum, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return checksum{}, fmt.Errorf("Invalid checksum: \"%s\", expected <algorithm>:<hex>", s)
+	}
+
+	c := checksum{name: strings.ToLower(parts[0])}
+	switch c.name {
+	case "md5":
+		c.hash = md5.New()
+	case "sha1":
+		c.hash = sha1.New()
+	case "sha256":
+		c.hash = sha256.New()
+	default:
+		return c, fmt.Errorf("Unknown checksum algorithm: \"%s\"", parts[0])
+	}
+
+	expected, err := hex.DecodeString(parts[1])
+	if err != nil || len(expected) != c.hash.Size() {
+		return c, fmt.Errorf("Invalid checksum: \"%s\"", s)
+	}
+	c.expected = expected
+	return c, nil
+}
+
+// responseChecksums returns the checksums the server sent with the file:
+// the Content-MD5 header, or the ETag of S3 objects uploaded in one part.
+// The ETag is only the MD5 of the content for unencrypted objects or objects encrypted with
+// S3 managed keys (AES256), not with KMS or customer keys, and not for multipart uploads ("<hash>-<parts>").
+func responseChecksums(resp *http.Response, s3 bool) []checksum {
+	checksums := []checksum{}
+	if v := resp.Header.Get("Content-MD5"); v != "" {
+		if expected, err := base64.StdEncoding.DecodeString(v); err == nil && len(expected) == md5.Size {
+			checksums = append(checksums, checksum{name: "Content-MD5", hash: md5.New(), expected: expected})
+		}
+	}
+
+	encryption := resp.Header.Get("x-amz-server-side-encryption")
+	customerKey := resp.Header.Get("x-amz-server-side-encryption-customer-algorithm")
+	if s3 && (encryption == "" || encryption == "AES256") && customerKey == "" {
+		etag := strings.Trim(resp.Header.Get("ETag"), "\"")
+		if strings.Contains(etag, "-") {
+			// Multipart upload
+			return checksums
+		}
+		if expected, err := hex.DecodeString(etag); err == nil && len(expected) == md5.Size {
+			checksums = append(checksums, checksum{name: "ETag", hash: md5.New(), expected: expected})
+		}
+	}
+
+	return checksums
+}
+
+// copyVerified copies at most limit bytes and checks the checksums of the copied data
+func copyVerified(dst io.Writer, src io.Reader, limit int64, checksums []checksum) error {
+	writers := []io.Writer{dst}
+	for _, c := range checksums {
+		writers = append(writers, c.hash)
+	}
+
+	n, err := io.Copy(io.MultiWriter(writers...), io.LimitReader(src, limit+1))
+	if err != nil {
+		return err
+	}
+
+	if n > limit {
+		return fmt.Errorf("File is larger than the limit of %d bytes", limit)
+	}
+
+	for _, c := range checksums {
+		if err := c.verify(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// s3Credentials are read from the usual AWS environment variables
+type s3Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+func s3CredentialsFromEnv() s3Credentials {
+	return s3Credentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3EscapePath encodes the path of an object as required for the signature
+func s3EscapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		segments[i] = strings.Replace(url.PathEscape(s), "+", "%2B", -1)
+	}
+	return strings.Join(segments, "/")
+}
+
+// signS3 adds an AWS Signature Version 4 to a request without a body.
+// The host and all headers already set on the request are signed.
+func signS3(req *http.Request, creds s3Credentials, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+
+	names := []string{}
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := ""
+	for _, k := range names {
+		canonicalHeaders += fmt.Sprintf("%s:%s\n", k, headers[k])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		strings.Replace(req.URL.Query().Encode(), "+", "%20", -1),
+		canonicalHeaders,
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, region)
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := fmt.Sprintf("AWS4-HMAC-SHA256\n%s\n%s\n%s", amzDate, scope, hex.EncodeToString(requestHash[:]))
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// s3URL is the path style url of an s3:// object
+func s3URL(u *url.URL) string {
+	endpoint := s3Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", s3Region)
+	}
+	return fmt.Sprintf("%s/%s%s", strings.TrimSuffix(endpoint, "/"), u.Host, u.EscapedPath())
+}
+
+// openSource starts the download of an http(s):// or s3:// file
+func openSource(ctx context.Context, file string) (*http.Response, error) {
+	u, err := url.Parse(file)
+	if err != nil {
+		return nil, err
+	}
+
+	s3 := u.Scheme == "s3"
+	if s3 {
+		file = s3URL(u)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, file, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	if creds := s3CredentialsFromEnv(); s3 && creds.AccessKeyID != "" {
+		signS3(req, creds, s3Region, time.Now())
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Download of \"%s\" failed: %s", file, resp.Status)
+	}
+
+	return resp, nil
+}
+
+// fetchSource streams a remote file into obj, verifying the size and checksums.
+// expectedChecksum is the checksum from the request, it can be empty.
+// Nothing is stored if the verification fails.
+func fetchSource(ctx context.Context, file, expectedChecksum string, obj *storage.ObjectHandle) error {
+	checksums := []checksum{}
+	if expectedChecksum != "" {
+		c, err := parseChecksum(expectedChecksum)
+		if err != nil {
+			return err
+		}
+		checksums = append(checksums, c)
+	}
+
+	resp, err := openSource(ctx, file)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.ContentLength > maxDownloadSize {
+		return fmt.Errorf("File is larger than the limit of %d bytes", maxDownloadSize)
+	}
+
+	checksums = append(checksums, responseChecksums(resp, strings.HasPrefix(file, "s3:"))...)
+
+	// Cancelling the context discards the upload
+	writeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	writer := obj.NewWriter(writeCtx)
+	writer.ContentType = resp.Header.Get("Content-Type")
+	if err := copyVerified(writer, resp.Body, maxDownloadSize, checksums); err != nil {
+		cancel()
+		writer.Close()
+		return err
+	}
+
+	return writer.Close()
+}
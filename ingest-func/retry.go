@@ -0,0 +1,200 @@
+package stt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	speech "cloud.google.com/go/speech/apiv1p1beta1"
+	"cloud.google.com/go/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxRetries is how many times a job is retried automatically after a transient error
+var maxRetries = parseMaxRetries(envOrDefault("MAX_RETRIES", "3"))
+
+func parseMaxRetries(s string) int {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		log.Printf("Invalid MAX_RETRIES \"%s\", using 0", s)
+		return 0
+	}
+	return n
+}
+
+// Attempt records a run of a job that was retried
+type Attempt struct {
+	JobID     string    `json:"job_id,omitempty"`
+	Chunks    []Chunk   `json:"chunks,omitempty"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	RetriedBy string    `json:"retried_by"`
+	RetriedAt time.Time `json:"retried_at"`
+}
+
+// RetryRequest is the body of the Retry endpoint
+type RetryRequest struct {
+	File    string `json:"file"`
+	User    string `json:"user"`
+	Comment string `json:"comment,omitempty"`
+}
+
+// isTransient is true for errors of the speech API that may go away by trying again
+func isTransient(err error) bool {
+	code := status.Code(err)
+	return code == codes.Unavailable || code == codes.DeadlineExceeded
+}
+
+// audioRequest is the request that was sent to the recognizer for the job, see startJob
+func (s FileStatus) audioRequest() IngestRequest {
+	audio := s.IngestRequest
+	audio.Phrases = s.SpeechContexts
+	audio.Vocabularies = nil
+	if s.TranscodedFile != "" {
+		audio = audio.transcodedRequest(fmt.Sprintf("gs://%s/%s", ingestBucketID, s.TranscodedFile))
+	}
+	return audio
+}
+
+// audioObject is the file the recognizer reads, it must still be there to retry the job
+func (s FileStatus) audioObject(storageClient *storage.Client, bucket string) *storage.ObjectHandle {
+	if len(s.Chunks) > 0 {
+		return storageClient.Bucket(ingestBucketID).Object(s.Chunks[0].File)
+	} else if s.TranscodedFile != "" {
+		return storageClient.Bucket(ingestBucketID).Object(s.TranscodedFile)
+	}
+	return storageClient.Bucket(bucket).Object(s.SourceFile)
+}
+
+// restart records the last run as an attempt and starts the recognition of the job again
+// with the same request. The source file is not transcoded or split again.
+// If the speech API quota is reached the job is left processing without operations.
+func (s *FileStatus) restart(ctx context.Context, client *speech.Client, by, comment string) error {
+	attempt := Attempt{
+		JobID:     s.JobID,
+		Chunks:    append([]Chunk{}, s.Chunks...),
+		Status:    s.Status,
+		Error:     s.Error,
+		RetriedBy: by,
+		RetriedAt: time.Now().UTC(),
+	}
+
+	if err := s.setStatus(StatusProcessing, by, comment); err != nil {
+		return err
+	}
+	s.Attempts = append(s.Attempts, attempt)
+	s.Error = ""
+	s.Progress = nil
+
+	s.JobID = ""
+	for i := range s.Chunks {
+		s.Chunks[i].JobID = ""
+	}
+	return s.submit(ctx, client)
+}
+
+// Retry starts a failed or cancelled job again with the same request.
+// The earlier runs are kept in the attempts of the status.
+func Retry(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.URL.Query().Get("key") != apiKey {
+		sendError(w, "Wrong key", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		sendError(w, "Only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	reqData := RetryRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		sendError(w, "Error parsing request", http.StatusBadRequest)
+		return
+	}
+
+	if reqData.User == "" {
+		sendError(w, "Field user is required", http.StatusBadRequest)
+		return
+	}
+
+	storageClient, err := storage.NewClient(ctx)
+	if err != nil {
+		sendError(w, fmt.Sprintf("Unable to create a storage client: %+v", err), http.StatusInternalServerError)
+		return
+	}
+
+	statusFile, fileStatus, ok := fileStatusFromRequest(w, r, storageClient, reqData.File)
+	if !ok {
+		return
+	}
+
+	if !canTransition(fileStatus.Status, StatusProcessing) {
+		sendError(w, fmt.Sprintf("A job with status \"%s\" can not be retried", fileStatus.Status), http.StatusConflict)
+		return
+	}
+
+	if _, err := fileStatus.audioObject(storageClient, statusFile.BucketName()).Attrs(ctx); err == storage.ErrObjectNotExist {
+		sendError(w, "The audio of the job was deleted, submit it again instead", http.StatusGone)
+		return
+	} else if err != nil {
+		sendError(w, fmt.Sprintf("Unable to read the audio: %+v", err), http.StatusInternalServerError)
+		return
+	}
+
+	client, err := speech.NewClient(ctx)
+	if err != nil {
+		sendError(w, "Can't connect to speech API. See log for more details.", http.StatusBadRequest)
+		return
+	}
+
+	err = fileStatus.restart(ctx, client, reqData.User, reqData.Comment)
+	if isQuotaError(err) {
+		err = fileStatus.queueJob("Waiting for the speech API quota")
+	}
+	if err != nil {
+		cancelOperations(ctx, client, fileStatus.operationNames())
+		errorText, httpCode := startErrorResponse(err, fileStatus.File)
+		sendError(w, errorText, httpCode)
+		return
+	}
+
+	// Failed and cancelled jobs were moved away from the status file the result processor reads
+	bucket := storageClient.Bucket(statusFile.BucketName())
+	activeFile := bucket.Object(fmt.Sprintf("status/%s.json", fileStatus.SourceFile))
+	if activeFile.ObjectName() == statusFile.ObjectName() {
+		err = writeStatus(ctx, statusFile, fileStatus)
+	} else {
+		err = writeStatus(ctx, activeFile.If(storage.Conditions{DoesNotExist: true}), fileStatus)
+		if err == nil {
+			if err := statusFile.Delete(ctx); err != nil {
+				log.Printf("Error removing old status of %s: %+v", fileStatus.SourceFile, err)
+			}
+		}
+	}
+
+	if err != nil {
+		// The operations that were started are not in any status
+		if err := cancelOperations(ctx, client, fileStatus.operationNames()); err != nil {
+			log.Printf("Error cancelling operations of %s: %+v", fileStatus.SourceFile, err)
+		}
+	}
+
+	if isConflict(err) {
+		sendError(w, "Status was changed by someone else, try again", http.StatusConflict)
+		return
+	} else if err != nil {
+		sendError(w, fmt.Sprintf("Unable to write status file: %+v", err), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("%s: retried by %s, op id: %s", fileStatus.SourceFile, reqData.User, fileStatus.JobID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fileStatus)
+}
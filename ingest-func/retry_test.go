@@ -0,0 +1,69 @@
+package stt
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func Test_isTransient(t *testing.T) {
+	assert.True(t, isTransient(status.Error(codes.Unavailable, "try again")))
+	assert.True(t, isTransient(status.Error(codes.DeadlineExceeded, "too slow")))
+	assert.False(t, isTransient(status.Error(codes.InvalidArgument, "bad audio")))
+	assert.False(t, isTransient(errors.New("other")))
+	assert.False(t, isTransient(nil))
+}
+
+func Test_audioRequest(t *testing.T) {
+	s := FileStatus{
+		IngestRequest: IngestRequest{
+			File:         "gs://bucket/file.mp4",
+			Transcode:    true,
+			Vocabularies: []string{"names"},
+		},
+		SpeechContexts: []PhraseSet{{Phrases: []string{"Brunstad"}}},
+		TranscodedFile: "transcoded/file.mp4.flac",
+	}
+
+	audio := s.audioRequest()
+	assert.Equal(t, "gs://"+ingestBucketID+"/transcoded/file.mp4.flac", audio.File)
+	assert.Equal(t, "FLAC", audio.EncodingString)
+	assert.Equal(t, s.SpeechContexts, audio.Phrases)
+	assert.Nil(t, audio.Vocabularies)
+
+	s.TranscodedFile = ""
+	assert.Equal(t, "gs://bucket/file.mp4", s.audioRequest().File)
+}
+
+func Test_restartFinished(t *testing.T) {
+	s := FileStatus{Status: StatusTranscribed, JobID: "op"}
+	assert.NotNil(t, s.restart(context.Background(), nil, "editor", ""))
+	assert.Equal(t, StatusTranscribed, s.Status)
+	assert.Len(t, s.Attempts, 0)
+
+	assert.True(t, canTransition(StatusError, StatusProcessing))
+	assert.True(t, canTransition(StatusCancelled, StatusProcessing))
+}
+
+func Test_restartProgress(t *testing.T) {
+	defer useTestBuckets()()
+	client, _, stop := newFakeSpeech(t)
+	defer stop()
+
+	s := FileStatus{IngestRequest: IngestRequest{File: "gs://ingest/a.flac", Language: "no-NO"}, Status: StatusError, JobID: "failed", Progress: &Progress{Percent: 40}}
+	assert.Nil(t, s.restart(context.Background(), client, "editor", ""))
+	assert.Equal(t, "op1", s.JobID)
+
+	// The progress of the failed attempt is not shown for the new one
+	assert.Nil(t, s.Progress)
+}
+
+func Test_parseMaxRetries(t *testing.T) {
+	assert.Equal(t, 3, parseMaxRetries("3"))
+	assert.Equal(t, 0, parseMaxRetries("-1"))
+	assert.Equal(t, 0, parseMaxRetries("many"))
+}
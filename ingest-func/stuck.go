@@ -0,0 +1,170 @@
+package stt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// DefaultMaxProcessingAge is how long a job may take if MAX_PROCESSING_AGE is not set
+const DefaultMaxProcessingAge = 24 * time.Hour
+
+// maxProcessingAge is how long after the submission a job is failed if it is not done.
+// "0" disables the limit.
+var maxProcessingAge = parseMaxProcessingAge(os.Getenv("MAX_PROCESSING_AGE"))
+
+func parseMaxProcessingAge(s string) time.Duration {
+	if s == "" {
+		return DefaultMaxProcessingAge
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		log.Printf("Invalid MAX_PROCESSING_AGE \"%s\", using %s", s, DefaultMaxProcessingAge)
+		return DefaultMaxProcessingAge
+	}
+	return d
+}
+
+// submitted is when the job was sent to the recognizer. Jobs from before SubmittedAt
+// was recorded, and jobs that were not sent yet, use the first status change, as every
+// write of the status file changes its creation time. The creation of the status file
+// is only used for jobs without history.
+func (s FileStatus) submitted(created time.Time) time.Time {
+	if !s.SubmittedAt.IsZero() {
+		return s.SubmittedAt
+	}
+	if len(s.History) > 0 && !s.History[0].At.IsZero() {
+		return s.History[0].At
+	}
+	return created
+}
+
+// expired is true for a job that has been processing for longer than maxProcessingAge
+func (s FileStatus) expired(created, now time.Time) bool {
+	return maxProcessingAge > 0 && s.Status == StatusProcessing && now.Sub(s.submitted(created)) > maxProcessingAge
+}
+
+// StuckJob is a job in the report of the StuckJobs endpoint
+type StuckJob struct {
+	File        string    `json:"file"`
+	Status      string    `json:"status"`
+	JobID       string    `json:"job_id,omitempty"`
+	Chunks      int       `json:"chunks,omitempty"`
+	SubmittedAt time.Time `json:"submitted_at"`
+	Age         string    `json:"age"`
+	AgeSeconds  int64     `json:"age_seconds"`
+}
+
+// stuckJobs lists the unfinished jobs in the ingest bucket that were submitted before now - olderThan
+func stuckJobs(ctx context.Context, bucket *storage.BucketHandle, olderThan time.Duration, now time.Time) ([]StuckJob, error) {
+	jobs := []StuckJob{}
+	objs := bucket.Objects(ctx, &storage.Query{Prefix: "status/"})
+	for {
+		attrs, err := objs.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return jobs, err
+		}
+
+		if !strings.HasSuffix(attrs.Name, ".json") {
+			// Finished jobs
+			continue
+		}
+
+		reader, err := bucket.Object(attrs.Name).NewReader(ctx)
+		if err == storage.ErrObjectNotExist {
+			// Finished since it was listed
+			continue
+		} else if err != nil {
+			return jobs, err
+		}
+
+		data, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return jobs, err
+		}
+
+		fileStatus, err := decodeStatus(data)
+		if err != nil {
+			log.Printf("Can't decode %s: %+v", attrs.Name, err)
+			continue
+		}
+
+		if job, ok := stuckJob(fileStatus, attrs.Created, olderThan, now); ok {
+			job.File = fmt.Sprintf("gs://%s/%s", attrs.Bucket, fileStatus.SourceFile)
+			jobs = append(jobs, job)
+		}
+	}
+
+	return jobs, nil
+}
+
+// stuckJob reports a queued or processing job that is older than olderThan
+func stuckJob(s FileStatus, created time.Time, olderThan time.Duration, now time.Time) (StuckJob, bool) {
+	if s.Status != StatusQueued && s.Status != StatusProcessing {
+		return StuckJob{}, false
+	}
+
+	submitted := s.submitted(created)
+	age := now.Sub(submitted)
+	if age <= olderThan {
+		return StuckJob{}, false
+	}
+
+	return StuckJob{
+		Status:      s.Status,
+		JobID:       s.JobID,
+		Chunks:      len(s.Chunks),
+		SubmittedAt: submitted,
+		Age:         age.Round(time.Second).String(),
+		AgeSeconds:  int64(age / time.Second),
+	}, true
+}
+
+// StuckJobs lists the jobs in the ingest bucket that are not finished after the
+// duration in the "older_than" parameter, 1h by default
+func StuckJobs(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.URL.Query().Get("key") != apiKey {
+		sendError(w, "Wrong key", http.StatusUnauthorized)
+		return
+	}
+
+	olderThan := time.Hour
+	if v := r.URL.Query().Get("older_than"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			sendError(w, fmt.Sprintf("Invalid older_than: \"%s\"", v), http.StatusBadRequest)
+			return
+		}
+		olderThan = d
+	}
+
+	storageClient, err := storage.NewClient(ctx)
+	if err != nil {
+		sendError(w, fmt.Sprintf("Unable to create a storage client: %+v", err), http.StatusInternalServerError)
+		return
+	}
+
+	jobs, err := stuckJobs(ctx, storageClient.Bucket(ingestBucketID), olderThan, time.Now())
+	if err != nil {
+		sendError(w, fmt.Sprintf("Unable to list jobs: %+v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jobs)
+}
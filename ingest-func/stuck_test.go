@@ -0,0 +1,54 @@
+package stt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseMaxProcessingAge(t *testing.T) {
+	assert.Equal(t, DefaultMaxProcessingAge, parseMaxProcessingAge(""))
+	assert.Equal(t, 6*time.Hour, parseMaxProcessingAge("6h"))
+	assert.Equal(t, time.Duration(0), parseMaxProcessingAge("0"))
+	assert.Equal(t, DefaultMaxProcessingAge, parseMaxProcessingAge("a day"))
+}
+
+func Test_expired(t *testing.T) {
+	created := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	s := FileStatus{Status: StatusProcessing}
+
+	assert.False(t, s.expired(created, created.Add(maxProcessingAge)))
+	assert.True(t, s.expired(created, created.Add(maxProcessingAge+time.Minute)))
+
+	// A retry starts the clock again
+	s.SubmittedAt = created.Add(maxProcessingAge)
+	assert.False(t, s.expired(created, created.Add(maxProcessingAge+time.Minute)))
+
+	s = FileStatus{Status: StatusQueued}
+	assert.False(t, s.expired(created, created.Add(10*maxProcessingAge)))
+
+	// Old jobs are timed from their first status change, not from the last write of the status file
+	s = FileStatus{Status: StatusProcessing, History: []StatusChange{{To: StatusProcessing, At: created}}}
+	rewritten := created.Add(maxProcessingAge)
+	assert.True(t, s.expired(rewritten, created.Add(maxProcessingAge+time.Minute)))
+}
+
+func Test_stuckJob(t *testing.T) {
+	created := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	s := FileStatus{Status: StatusProcessing, JobID: "op", SubmittedAt: created.Add(time.Hour)}
+
+	job, ok := stuckJob(s, created, time.Hour, created.Add(3*time.Hour))
+	assert.True(t, ok)
+	assert.Equal(t, "op", job.JobID)
+	assert.Equal(t, s.SubmittedAt, job.SubmittedAt)
+	assert.Equal(t, "2h0m0s", job.Age)
+	assert.Equal(t, int64(7200), job.AgeSeconds)
+
+	_, ok = stuckJob(s, created, time.Hour, created.Add(90*time.Minute))
+	assert.False(t, ok)
+
+	s.Status = StatusTranscribed
+	_, ok = stuckJob(s, created, time.Hour, created.Add(3*time.Hour))
+	assert.False(t, ok)
+}
@@ -0,0 +1,106 @@
+package stt
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	speech "cloud.google.com/go/speech/apiv1p1beta1"
+	"cloud.google.com/go/storage"
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1p1beta1"
+)
+
+// MaxSyncDuration is the longest audio the synchronous recognizer accepts
+const MaxSyncDuration = time.Minute
+
+// maxSyncSize is used to skip probing files that are too big to be short clips
+const maxSyncSize = 10 << 20
+
+var (
+	ffprobePath = envOrDefault("FFPROBE_PATH", "ffprobe")
+
+	// syncMaxDuration enables the synchronous fast path for clips shorter than this.
+	// It is disabled if SYNC_MAX_DURATION is not set.
+	syncMaxDuration = parseSyncMaxDuration(os.Getenv("SYNC_MAX_DURATION"))
+)
+
+func parseSyncMaxDuration(s string) time.Duration {
+	if s == "" {
+		return 0
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		log.Printf("Invalid SYNC_MAX_DURATION \"%s\", synchronous recognition is disabled: %+v", s, err)
+		return 0
+	}
+
+	if d > MaxSyncDuration {
+		log.Printf("SYNC_MAX_DURATION %s exceeds the limit of the recognizer. Using %s", d, MaxSyncDuration)
+		return MaxSyncDuration
+	}
+
+	return d
+}
+
+// probeDuration returns the duration of the audio in obj as reported by ffprobe.
+// ffprobe reads only what it needs of obj straight from the bucket.
+func probeDuration(ctx context.Context, obj *storage.ObjectHandle) (time.Duration, error) {
+	uri, options, err := storageInput(ctx, obj)
+	if err != nil {
+		return 0, err
+	}
+
+	args := append(options, "-v", "error", "-show_entries", "format=duration", "-of", "csv=p=0", uri)
+	out, err := exec.CommandContext(ctx, ffprobePath, args...).Output()
+	if err != nil {
+		return 0, fmt.Errorf("ffprobe failed: %v", err)
+	}
+
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse duration \"%s\": %v", out, err)
+	}
+
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// isShortClip checks if obj can be recognized synchronously
+func isShortClip(ctx context.Context, obj *storage.ObjectHandle) bool {
+	if syncMaxDuration == 0 {
+		return false
+	}
+
+	attrs, err := obj.Attrs(ctx)
+	if err != nil || attrs.Size > maxSyncSize {
+		return false
+	}
+
+	d, err := probeDuration(ctx, obj)
+	if err != nil {
+		log.Printf("Unable to determine duration of %s, using asynchronous recognition: %+v", obj.ObjectName(), err)
+		return false
+	}
+
+	return d <= syncMaxDuration
+}
+
+// recognizeSync transcribes the audio immediately
+func recognizeSync(ctx context.Context, client *speech.Client, audio IngestRequest) ([]*speechpb.SpeechRecognitionResult, error) {
+	resp, err := client.Recognize(ctx, &speechpb.RecognizeRequest{
+		Config: recognitionConfig(audio),
+		Audio: &speechpb.RecognitionAudio{
+			AudioSource: &speechpb.RecognitionAudio_Uri{Uri: audio.File},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.GetResults(), nil
+}
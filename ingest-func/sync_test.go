@@ -0,0 +1,15 @@
+package stt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseSyncMaxDuration(t *testing.T) {
+	assert.Equal(t, time.Duration(0), parseSyncMaxDuration(""))
+	assert.Equal(t, time.Duration(0), parseSyncMaxDuration("soon"))
+	assert.Equal(t, 45*time.Second, parseSyncMaxDuration("45s"))
+	assert.Equal(t, MaxSyncDuration, parseSyncMaxDuration("5m"))
+}
@@ -0,0 +1,156 @@
+package stt
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2/google"
+)
+
+// TranscodeSampleRate is the sample rate of the FLAC files produced by the transcoding stage.
+// 16kHz is what the recognizer is optimized for.
+const TranscodeSampleRate = 16000
+
+// transcodedPrefix is where derived audio files are stored in the ingest bucket
+const transcodedPrefix = "transcoded/"
+
+var ffmpegPath = envOrDefault("FFMPEG_PATH", "ffmpeg")
+
+// transcodeExtensions lists the containers that can not be sent to the recognizer as-is
+var transcodeExtensions = map[string]bool{
+	".mp4":  true,
+	".m4a":  true,
+	".aac":  true,
+	".mov":  true,
+	".mxf":  true,
+	".mkv":  true,
+	".webm": true,
+	".avi":  true,
+	".wma":  true,
+}
+
+func envOrDefault(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// NeedsTranscode is true if the audio has to be extracted before it can be recognized
+func (r IngestRequest) NeedsTranscode() bool {
+	return r.Transcode || transcodeExtensions[strings.ToLower(path.Ext(r.File))]
+}
+
+// transcodedRequest returns a copy of the request describing the transcoded file
+func (r IngestRequest) transcodedRequest(uri string) IngestRequest {
+	r.File = uri
+	r.EncodingString = "FLAC"
+	r.SampleRateHertz = TranscodeSampleRate
+	r.Channels = 1
+	r.Transcode = false
+	return r
+}
+
+// ffmpegArgs builds the arguments to extract mono FLAC audio from src.
+// If length is not 0 only the part starting at start is extracted.
+func ffmpegArgs(src, dst string, start, length time.Duration) []string {
+	args := []string{"-nostdin", "-y", "-loglevel", "error"}
+	if length > 0 {
+		args = append(args, "-ss", fmt.Sprintf("%.3f", start.Seconds()), "-t", fmt.Sprintf("%.3f", length.Seconds()))
+	} else if start > 0 {
+		args = append(args, "-ss", fmt.Sprintf("%.3f", start.Seconds()))
+	}
+
+	return append(args,
+		"-i", src,
+		// Keep only the first audio track and downmix it to mono
+		"-vn", "-map", "0:a:0", "-ac", "1",
+		"-ar", fmt.Sprintf("%d", TranscodeSampleRate),
+		"-c:a", "flac", "-f", "flac",
+		dst,
+	)
+}
+
+// runFFmpeg executes the local ffmpeg binary and returns what it logged
+func runFFmpeg(ctx context.Context, args ...string) (string, error) {
+	return streamFFmpeg(ctx, nil, args...)
+}
+
+// streamFFmpeg is runFFmpeg with the output written to "pipe:1" going to stdout
+func streamFFmpeg(ctx context.Context, stdout io.Writer, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, ffmpegPath, args...)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	cmd.Stdout = stdout
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("ffmpeg failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stderr.String(), nil
+}
+
+// storageInput returns the url and the ffmpeg input options to read obj straight from cloud storage.
+// ffmpeg seeks with range requests, so the media does not have to fit in the memory backed /tmp.
+func storageInput(ctx context.Context, obj *storage.ObjectHandle) (string, []string, error) {
+	tokens, err := google.DefaultTokenSource(ctx, storage.ScopeReadOnly)
+	if err != nil {
+		return "", nil, err
+	}
+
+	token, err := tokens.Token()
+	if err != nil {
+		return "", nil, err
+	}
+
+	u := url.URL{Scheme: "https", Host: "storage.googleapis.com", Path: "/" + obj.BucketName() + "/" + obj.ObjectName()}
+	return u.String(), []string{"-headers", "Authorization: Bearer " + token.AccessToken + "\r\n"}, nil
+}
+
+// transcode extracts the audio track of src into a mono FLAC file and stores it in the ingest bucket.
+// The audio is streamed from ffmpeg into the bucket. The name of the created object is returned.
+func transcode(ctx context.Context, src *storage.ObjectHandle, ingestBucket *storage.BucketHandle) (string, error) {
+	uri, options, err := storageInput(ctx, src)
+	if err != nil {
+		return "", fmt.Errorf("unable to read %s: %v", src.ObjectName(), err)
+	}
+	args := append(options, ffmpegArgs(uri, "pipe:1", 0, 0)...)
+
+	dst := ingestBucket.Object(fmt.Sprintf("%s%s.flac", transcodedPrefix, src.ObjectName()))
+	if err := ffmpegToObject(ctx, dst, args...); err != nil {
+		return "", err
+	}
+
+	log.Printf("Transcoded %s to %s", src.ObjectName(), dst.ObjectName())
+	return dst.ObjectName(), nil
+}
+
+// ffmpegToObject runs ffmpeg and streams the FLAC audio it writes to "pipe:1" into dst
+func ffmpegToObject(ctx context.Context, dst *storage.ObjectHandle, args ...string) error {
+	// Cancelling the writer keeps a partial file from being stored
+	writerCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	writer := dst.NewWriter(writerCtx)
+	writer.ContentType = "audio/flac"
+
+	if _, err := streamFFmpeg(ctx, writer, args...); err != nil {
+		cancel()
+		writer.Close()
+		return err
+	}
+
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("unable to upload %s: %v", dst.ObjectName(), err)
+	}
+	return nil
+}
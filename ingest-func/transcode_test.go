@@ -0,0 +1,22 @@
+package stt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1p1beta1"
+)
+
+func Test_NeedsTranscode(t *testing.T) {
+	assert.True(t, IngestRequest{File: "gs://b/program.MXF"}.NeedsTranscode())
+	assert.True(t, IngestRequest{File: "gs://b/audio.flac", Transcode: true}.NeedsTranscode())
+	assert.False(t, IngestRequest{File: "gs://b/audio.flac"}.NeedsTranscode())
+
+	// Encoding is not validated for files that are transcoded
+	assert.NoError(t, IngestRequest{File: "gs://b/program.mp4"}.Validate())
+
+	audio := IngestRequest{File: "gs://b/program.mp4", Channels: 2}.transcodedRequest("gs://i/transcoded/program.mp4.flac")
+	assert.Equal(t, speechpb.RecognitionConfig_FLAC, audio.Encoding())
+	assert.Equal(t, int32(1), audio.Channels)
+	assert.NoError(t, audio.Validate())
+}
@@ -0,0 +1,169 @@
+package stt
+
+import (
+	"strings"
+	"time"
+
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1p1beta1"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Transcript is the structure of the JSON output
+type Transcript struct {
+	Language string    `json:"lang"`
+	Segments []Segment `json:"segments"`
+}
+
+// Segment is one recognition result. Times are in seconds from the start of the file
+type Segment struct {
+	Start      float64 `json:"start"`
+	End        float64 `json:"end"`
+	Text       string  `json:"text"`
+	Confidence float32 `json:"confidence"`
+	// Language the segment was recognized in
+	Language string `json:"lang"`
+	Words    []Word `json:"words"`
+	// Alternatives are the other hypotheses of the recognizer, best first
+	Alternatives []Alternative `json:"alternatives,omitempty"`
+}
+
+// Alternative is a less likely hypothesis for a segment
+type Alternative struct {
+	Text       string  `json:"text"`
+	Confidence float32 `json:"confidence"`
+	Words      []Word  `json:"words,omitempty"`
+}
+
+// Word is a single recognized word with its timing
+type Word struct {
+	Word          string  `json:"word"`
+	Start         float64 `json:"start"`
+	End           float64 `json:"end"`
+	Confidence    float32 `json:"confidence,omitempty"`
+	LowConfidence bool    `json:"low_confidence,omitempty"`
+}
+
+// LanguageSpan is a part of the file recognized in one language
+type LanguageSpan struct {
+	Start    float64 `json:"start"`
+	End      float64 `json:"end"`
+	Language string  `json:"lang"`
+}
+
+// Text joins the text of all segments
+func (t Transcript) Text() string {
+	texts := []string{}
+	for _, s := range t.Segments {
+		texts = append(texts, s.Text)
+	}
+	return strings.Join(texts, "\n")
+}
+
+func seconds(d *durationpb.Duration) float64 {
+	return d.AsDuration().Seconds()
+}
+
+func duration(s float64) *durationpb.Duration {
+	return durationpb.New(time.Duration(s * float64(time.Second)))
+}
+
+func wordsFromInfo(info []*speechpb.WordInfo) []Word {
+	words := []Word{}
+	for _, w := range info {
+		words = append(words, Word{
+			Word:       w.Word,
+			Start:      seconds(w.StartTime),
+			End:        seconds(w.EndTime),
+			Confidence: w.Confidence,
+		})
+	}
+	return words
+}
+
+// transcriptFromResults converts the recognizer results into the JSON output structure.
+// Segments without a language are assumed to be in lang.
+func transcriptFromResults(results []*speechpb.SpeechRecognitionResult, lang string) Transcript {
+	t := Transcript{
+		Language: lang,
+		Segments: []Segment{},
+	}
+
+	for _, r := range results {
+		if len(r.Alternatives) == 0 {
+			continue
+		}
+
+		alt := r.Alternatives[0]
+		segment := Segment{
+			Text:       strings.TrimSpace(alt.Transcript),
+			Confidence: alt.Confidence,
+			Language:   r.LanguageCode,
+		}
+
+		if segment.Language == "" {
+			segment.Language = lang
+		}
+
+		segment.Words = wordsFromInfo(alt.Words)
+		for _, a := range r.Alternatives[1:] {
+			segment.Alternatives = append(segment.Alternatives, Alternative{
+				Text:       strings.TrimSpace(a.Transcript),
+				Confidence: a.Confidence,
+				Words:      wordsFromInfo(a.Words),
+			})
+		}
+
+		if len(segment.Words) > 0 {
+			segment.Start = segment.Words[0].Start
+			segment.End = segment.Words[len(segment.Words)-1].End
+		}
+
+		t.Segments = append(t.Segments, segment)
+	}
+
+	return t
+}
+
+// languageSpans merges consecutive segments recognized in the same language
+func (t Transcript) languageSpans() []LanguageSpan {
+	spans := []LanguageSpan{}
+	for _, s := range t.Segments {
+		last := len(spans) - 1
+		if last >= 0 && strings.EqualFold(spans[last].Language, s.Language) {
+			spans[last].End = s.End
+			continue
+		}
+
+		spans = append(spans, LanguageSpan{Start: s.Start, End: s.End, Language: s.Language})
+	}
+
+	return spans
+}
+
+// results converts the transcript back into recognizer results, so it can be rendered in the other formats.
+// Only the best alternative is kept.
+func (t Transcript) results() []*speechpb.SpeechRecognitionResult {
+	results := []*speechpb.SpeechRecognitionResult{}
+	for _, s := range t.Segments {
+		alt := &speechpb.SpeechRecognitionAlternative{
+			Transcript: s.Text,
+			Confidence: s.Confidence,
+		}
+
+		for _, w := range s.Words {
+			alt.Words = append(alt.Words, &speechpb.WordInfo{
+				Word:       w.Word,
+				StartTime:  duration(w.Start),
+				EndTime:    duration(w.End),
+				Confidence: w.Confidence,
+			})
+		}
+
+		results = append(results, &speechpb.SpeechRecognitionResult{
+			Alternatives: []*speechpb.SpeechRecognitionAlternative{alt},
+			LanguageCode: s.Language,
+		})
+	}
+
+	return results
+}
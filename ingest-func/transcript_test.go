@@ -0,0 +1,57 @@
+package stt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	speechpb "google.golang.org/genproto/googleapis/cloud/speech/v1p1beta1"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func testResult(lang string, start time.Duration, words ...string) *speechpb.SpeechRecognitionResult {
+	alt := &speechpb.SpeechRecognitionAlternative{Confidence: 0.9}
+	for i, w := range words {
+		alt.Transcript += " " + w
+		alt.Words = append(alt.Words, &speechpb.WordInfo{
+			Word:      w,
+			StartTime: durationpb.New(start + time.Duration(i)*time.Second),
+			EndTime:   durationpb.New(start + time.Duration(i+1)*time.Second),
+		})
+	}
+
+	return &speechpb.SpeechRecognitionResult{
+		Alternatives: []*speechpb.SpeechRecognitionAlternative{alt},
+		LanguageCode: lang,
+	}
+}
+
+func Test_transcriptFromResults(t *testing.T) {
+	transcript := transcriptFromResults([]*speechpb.SpeechRecognitionResult{
+		testResult("", 0, "God", "morgen"),
+		testResult("no-no", 2*time.Second, "alle", "sammen"),
+		testResult("en-us", 4*time.Second, "good", "morning"),
+	}, "no-NO")
+
+	assert.Len(t, transcript.Segments, 3)
+	assert.Equal(t, "God morgen", transcript.Segments[0].Text)
+	assert.Equal(t, "no-NO", transcript.Segments[0].Language)
+	assert.Equal(t, 2.0, transcript.Segments[1].Start)
+	assert.Equal(t, 4.0, transcript.Segments[1].End)
+
+	assert.Nil(t, transcript.Segments[0].Alternatives)
+
+	assert.Equal(t, []LanguageSpan{
+		{Start: 0, End: 4, Language: "no-NO"},
+		{Start: 4, End: 6, Language: "en-us"},
+	}, transcript.languageSpans())
+}
+
+func Test_transcriptFromResults_alternatives(t *testing.T) {
+	result := testResult("", 0, "Brunstad")
+	result.Alternatives = append(result.Alternatives, &speechpb.SpeechRecognitionAlternative{Transcript: "brun stad", Confidence: 0.4})
+
+	transcript := transcriptFromResults([]*speechpb.SpeechRecognitionResult{result}, "no-NO")
+	assert.Equal(t, "Brunstad", transcript.Segments[0].Text)
+	assert.Equal(t, []Alternative{{Text: "brun stad", Confidence: 0.4, Words: []Word{}}}, transcript.Segments[0].Alternatives)
+}
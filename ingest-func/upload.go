@@ -0,0 +1,200 @@
+package stt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/functions/metadata"
+	speech "cloud.google.com/go/speech/apiv1p1beta1"
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// defaultLanguage is used for uploads that do not set a language. Uploads without one are not started.
+var defaultLanguage = envOrDefault("DEFAULT_LANGUAGE", "")
+
+// maxEventAge is how long a failed upload event is retried
+const maxEventAge = time.Hour
+
+// internalPrefixes are the parts of the ingest bucket written by the functions themselves
+var internalPrefixes = []string{"status/", transcodedPrefix, chunksPrefix, vocabulariesPrefix, downloadsPrefix}
+
+// GCSEvent is the payload of the storage events
+type GCSEvent struct {
+	Bucket   string            `json:"bucket"`
+	Name     string            `json:"name"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+func isInternalObject(name string) bool {
+	for _, prefix := range internalPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAudioObject is true for the files that can be recognized, directly or after transcoding
+func isAudioObject(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	_, ok := encodingExtensions[ext]
+	return ok || transcodeExtensions[ext]
+}
+
+// sidecarNames are the names of the files with options for an upload, in the order they are tried
+func sidecarNames(name string) []string {
+	return []string{
+		strings.TrimSuffix(name, path.Ext(name)) + ".json",
+		name + ".json",
+	}
+}
+
+// metadataOptions converts object metadata into request fields. The keys are the JSON field names,
+// values that are valid JSON are decoded, so "10" is a number and "[\"en-US\"]" a list.
+func metadataOptions(metadata map[string]string) ([]byte, error) {
+	fields := map[string]interface{}{}
+	for k, v := range metadata {
+		var value interface{}
+		if err := json.Unmarshal([]byte(v), &value); err != nil {
+			value = v
+		}
+		fields[k] = value
+	}
+	return json.Marshal(fields)
+}
+
+// uploadRequest builds the request for an uploaded file from its sidecar file and metadata.
+// The metadata takes precedence.
+func uploadRequest(ctx context.Context, bucket *storage.BucketHandle, name string, metadata map[string]string) (IngestRequest, error) {
+	reqData := IngestRequest{Language: defaultLanguage}
+
+	for _, sidecar := range sidecarNames(name) {
+		reader, err := bucket.Object(sidecar).NewReader(ctx)
+		if err == storage.ErrObjectNotExist {
+			continue
+		} else if err != nil {
+			return reqData, err
+		}
+
+		data, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return reqData, err
+		}
+
+		if err := json.Unmarshal(data, &reqData); err != nil {
+			return reqData, fmt.Errorf("Sidecar \"%s\" is not valid: %v", sidecar, err)
+		}
+		break
+	}
+
+	options, err := metadataOptions(metadata)
+	if err != nil {
+		return reqData, err
+	}
+
+	if err := json.Unmarshal(options, &reqData); err != nil {
+		return reqData, fmt.Errorf("Metadata is not valid: %v", err)
+	}
+
+	return reqData, nil
+}
+
+// audioForSidecar finds the uploaded file a sidecar file belongs to, if it is there already
+func audioForSidecar(ctx context.Context, bucket *storage.BucketHandle, sidecar string) (*storage.ObjectAttrs, error) {
+	objs := bucket.Objects(ctx, &storage.Query{Prefix: strings.TrimSuffix(sidecar, ".json")})
+	for {
+		attrs, err := objs.Next()
+		if err == iterator.Done {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		if isAudioObject(attrs.Name) {
+			for _, name := range sidecarNames(attrs.Name) {
+				if name == sidecar {
+					return attrs, nil
+				}
+			}
+		}
+	}
+}
+
+// OnUpload starts a job when a file is uploaded to the ingest bucket.
+// The options are read from the metadata of the object and from a sidecar file, see uploadRequest.
+// A sidecar uploaded after the file starts the job too, unless the file was started without it.
+// Errors that may go away are returned, so the event is retried, for at most maxEventAge.
+func OnUpload(ctx context.Context, e GCSEvent) error {
+	if isInternalObject(e.Name) {
+		return nil
+	}
+
+	if meta, err := metadata.FromContext(ctx); err == nil && time.Since(meta.Timestamp) > maxEventAge {
+		log.Printf("Not starting %s: the upload event is older than %s", e.Name, maxEventAge)
+		return nil
+	}
+
+	storageClient, err := storage.NewClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	bucket := storageClient.Bucket(e.Bucket)
+	name, metadata := e.Name, e.Metadata
+	if strings.HasSuffix(e.Name, ".json") {
+		attrs, err := audioForSidecar(ctx, bucket, e.Name)
+		if err != nil || attrs == nil {
+			return err
+		}
+		name, metadata = attrs.Name, attrs.Metadata
+
+		// With DEFAULT_LANGUAGE the file may have been started without the sidecar
+		if _, _, err := findStatus(ctx, bucket, name); err == nil {
+			log.Printf("Sidecar %s was uploaded after %s was started and is not used, upload the sidecar first", e.Name, name)
+			return nil
+		} else if err != storage.ErrObjectNotExist {
+			return err
+		}
+	} else if !isAudioObject(e.Name) {
+		return nil
+	}
+
+	reqData, err := uploadRequest(ctx, bucket, name, metadata)
+	if err != nil {
+		log.Printf("Not starting %s: %v", name, err)
+		return nil
+	}
+
+	if reqData.Language == "" {
+		log.Printf("Not starting %s: no language in the metadata or a sidecar file", name)
+		return nil
+	}
+	reqData.File = fmt.Sprintf("gs://%s/%s", e.Bucket, name)
+
+	client, err := speech.NewClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	fStatus, err := startJob(ctx, client, storageClient, reqData)
+	if err != nil {
+		log.Printf("Not starting %s: %v", name, err)
+		if errorStatusCode(err) >= http.StatusInternalServerError {
+			// Let the event be retried, see the failure policy of the function
+			return err
+		}
+		return nil
+	}
+
+	log.Printf("Started %s on upload, status %s", reqData.File, fStatus.Status)
+	return nil
+}
@@ -0,0 +1,34 @@
+package stt
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_metadataOptions(t *testing.T) {
+	options, err := metadataOptions(map[string]string{
+		"lang":          "no-NO",
+		"alt_langs":     `["en-US"]`,
+		"chunk_minutes": "10",
+		"transcode":     "true",
+	})
+	assert.Nil(t, err)
+
+	reqData := IngestRequest{}
+	assert.Nil(t, json.Unmarshal(options, &reqData))
+	assert.Equal(t, IngestRequest{Language: "no-NO", AlternativeLanguages: []string{"en-US"}, ChunkMinutes: 10, Transcode: true}, reqData)
+}
+
+func Test_uploadObjects(t *testing.T) {
+	assert.True(t, isInternalObject("status/a.wav.json"))
+	assert.True(t, isInternalObject("transcoded/a.flac"))
+	assert.False(t, isInternalObject("2021/status/a.wav"))
+
+	assert.True(t, isAudioObject("a.WAV"))
+	assert.True(t, isAudioObject("a.mp4"))
+	assert.False(t, isAudioObject("a.json"))
+
+	assert.Equal(t, []string{"dir/a.json", "dir/a.wav.json"}, sidecarNames("dir/a.wav"))
+}
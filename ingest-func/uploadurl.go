@@ -0,0 +1,317 @@
+package stt
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iamcredentials/v1"
+	"google.golang.org/api/iterator"
+)
+
+// uploadsPrefix is where files uploaded with a signed url are stored in the ingest bucket
+const uploadsPrefix = "uploads/"
+
+// MaxUploadURLExpiry is the longest validity of a V4 signed url
+const MaxUploadURLExpiry = 7 * 24 * time.Hour
+
+var (
+	// uploadURLExpiry is how long a signed upload url is valid
+	uploadURLExpiry = parseUploadURLExpiry(envOrDefault("UPLOAD_URL_EXPIRY", "1h"))
+
+	// signingAccount is the service account that signs the upload urls.
+	// It defaults to the account the function runs as.
+	signingAccount = os.Getenv("SIGNING_ACCOUNT")
+
+	// uploadKey only gives access to UploadURL, so it can be used in browsers instead of FUNCTION_KEY
+	uploadKey = os.Getenv("UPLOAD_KEY")
+
+	// uploadOrigins are the origins browsers may call UploadURL from, "*" allows all.
+	// Without UPLOAD_ORIGINS browsers can not call it.
+	uploadOrigins = strings.Split(os.Getenv("UPLOAD_ORIGINS"), ",")
+)
+
+func parseUploadURLExpiry(s string) time.Duration {
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		log.Printf("Invalid UPLOAD_URL_EXPIRY \"%s\", using 1h", s)
+		return time.Hour
+	}
+
+	if d > MaxUploadURLExpiry {
+		log.Printf("UPLOAD_URL_EXPIRY %s exceeds the limit of signed urls. Using %s", d, MaxUploadURLExpiry)
+		return MaxUploadURLExpiry
+	}
+
+	return d
+}
+
+// UploadURLRequest is an Ingest request for a file that is not uploaded yet.
+// File is the name of the file, without a path.
+type UploadURLRequest struct {
+	IngestRequest
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// UploadURLResponse tells the client where to upload the file.
+// The upload must be a PUT with the headers in Headers.
+type UploadURLResponse struct {
+	URL     string            `json:"url"`
+	Method  string            `json:"method"`
+	Headers map[string]string `json:"headers"`
+	Expires time.Time         `json:"expires"`
+	File    string            `json:"file"`
+}
+
+// uploadObjectName is where a file with the given name is uploaded. Every upload gets its own
+// folder, so files with the same name do not overwrite each other or each other's options.
+func uploadObjectName(name, id string) (string, error) {
+	base := path.Base(strings.Replace(name, "\\", "/", -1))
+	if base == "." || base == "/" || strings.TrimSpace(base) == "" {
+		return "", fmt.Errorf("Field file must be the name of the file")
+	}
+
+	if !isAudioObject(base) {
+		return "", fmt.Errorf("Unsupported file type: \"%s\"", path.Ext(base))
+	}
+
+	return fmt.Sprintf("%s%s/%s", uploadsPrefix, id, base), nil
+}
+
+func newUploadID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return time.Now().UTC().Format("20060102") + "-" + hex.EncodeToString(b), nil
+}
+
+// signBlob signs with the key of a service account through the IAM credentials API,
+// which is how functions without a key file can sign urls
+func signBlob(ctx context.Context, account string) (func([]byte) ([]byte, error), error) {
+	service, err := iamcredentials.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	name := fmt.Sprintf("projects/-/serviceAccounts/%s", account)
+	return func(b []byte) ([]byte, error) {
+		resp, err := service.Projects.ServiceAccounts.SignBlob(name, &iamcredentials.SignBlobRequest{
+			Payload: base64.StdEncoding.EncodeToString(b),
+		}).Context(ctx).Do()
+		if err != nil {
+			return nil, err
+		}
+		return base64.StdEncoding.DecodeString(resp.SignedBlob)
+	}, nil
+}
+
+// signedUploadURL returns a V4 signed url to PUT the object into the ingest bucket
+func signedUploadURL(ctx context.Context, object, contentType string, expires time.Time) (string, error) {
+	account := signingAccount
+	if account == "" {
+		var err error
+		account, err = metadata.Email("default")
+		if err != nil {
+			return "", fmt.Errorf("Unable to find the signing account, set SIGNING_ACCOUNT: %v", err)
+		}
+	}
+
+	sign, err := signBlob(ctx, account)
+	if err != nil {
+		return "", err
+	}
+
+	return storage.SignedURL(ingestBucketID, object, &storage.SignedURLOptions{
+		GoogleAccessID: account,
+		SignBytes:      sign,
+		Method:         http.MethodPut,
+		Expires:        expires,
+		ContentType:    contentType,
+		Scheme:         storage.SigningSchemeV4,
+	})
+}
+
+// writeSidecar stores the options of an upload next to it, where OnUpload reads them
+func writeSidecar(ctx context.Context, bucket *storage.BucketHandle, object string, reqData IngestRequest) error {
+	reqData.File = ""
+	writer := bucket.Object(sidecarNames(object)[0]).NewWriter(ctx)
+	writer.ContentType = "application/json"
+	if err := json.NewEncoder(writer).Encode(reqData); err != nil {
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
+// uploadGrace is how long after the url expired an upload that was started in time may still be running
+const uploadGrace = 24 * time.Hour
+
+// unusedSidecars returns the sidecars in uploads/ whose url has expired without a file being uploaded,
+// or whose file was processed and removed
+func unusedSidecars(objs []*storage.ObjectAttrs, now time.Time) []string {
+	uploaded := map[string]bool{}
+	for _, attrs := range objs {
+		if !strings.HasSuffix(attrs.Name, ".json") {
+			uploaded[path.Dir(attrs.Name)] = true
+		}
+	}
+
+	unused := []string{}
+	for _, attrs := range objs {
+		if strings.HasSuffix(attrs.Name, ".json") && !uploaded[path.Dir(attrs.Name)] && now.Sub(attrs.Created) > uploadURLExpiry+uploadGrace {
+			unused = append(unused, attrs.Name)
+		}
+	}
+	return unused
+}
+
+// deleteUnusedSidecars removes the sidecars of the upload urls that are no longer used, see unusedSidecars
+func deleteUnusedSidecars(ctx context.Context, bucket *storage.BucketHandle) {
+	objs := []*storage.ObjectAttrs{}
+	it := bucket.Objects(ctx, &storage.Query{Prefix: uploadsPrefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			log.Printf("Can't list uploads: %+v", err)
+			return
+		}
+		objs = append(objs, attrs)
+	}
+
+	for _, name := range unusedSidecars(objs, time.Now()) {
+		if err := bucket.Object(name).Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+			log.Printf("Can't delete unused sidecar %s: %+v", name, err)
+		}
+	}
+}
+
+// allowedOrigin returns the value of the Access-Control-Allow-Origin header for the origin, or "" if it is not allowed
+func allowedOrigin(origin string) string {
+	for _, o := range uploadOrigins {
+		o = strings.TrimSpace(o)
+		if o == "*" {
+			return "*"
+		} else if o != "" && o == origin {
+			return origin
+		}
+	}
+	return ""
+}
+
+// UploadURL returns a signed url for uploading a file into the ingest bucket.
+// The options of the job are stored as the sidecar of the upload, so the job is started
+// by OnUpload when the upload is completed. It can be called from browsers with UPLOAD_KEY.
+func UploadURL(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if origin := allowedOrigin(r.Header.Get("Origin")); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Max-Age", "3600")
+	}
+	w.Header().Add("Vary", "Origin")
+
+	if r.Method == http.MethodOptions {
+		// CORS preflight
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	key := r.URL.Query().Get("key")
+	if key != apiKey && (uploadKey == "" || key != uploadKey) {
+		sendError(w, "Wrong key", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		sendError(w, "Only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	upload := UploadURLRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&upload); err != nil {
+		sendError(w, fmt.Sprintf("Error parsing request: %+v", err), http.StatusBadRequest)
+		return
+	}
+
+	reqData := upload.IngestRequest
+	if reqData.Language == "" {
+		reqData.Language = defaultLanguage
+	}
+	if reqData.Language == "" {
+		sendError(w, "Field lang is required", http.StatusBadRequest)
+		return
+	}
+
+	id, err := newUploadID()
+	if err != nil {
+		sendError(w, fmt.Sprintf("Unable to create an upload id: %+v", err), http.StatusInternalServerError)
+		return
+	}
+
+	object, err := uploadObjectName(reqData.File, id)
+	if err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	reqData.File = fmt.Sprintf("gs://%s/%s", ingestBucketID, object)
+	if err := reqData.Validate(); err != nil {
+		sendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	contentType := upload.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(path.Ext(object))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	storageClient, err := storage.NewClient(ctx)
+	if err != nil {
+		sendError(w, fmt.Sprintf("Unable to create a storage client: %+v", err), http.StatusInternalServerError)
+		return
+	}
+
+	expires := time.Now().Add(uploadURLExpiry)
+	signedURL, err := signedUploadURL(ctx, object, contentType, expires)
+	if err != nil {
+		log.Printf("Error signing upload url: %+v", err)
+		sendError(w, "Unable to sign the upload url. See log for more details.", http.StatusInternalServerError)
+		return
+	}
+
+	// The url is only returned once the sidecar is there, so it is read when the upload is done
+	if err := writeSidecar(ctx, storageClient.Bucket(ingestBucketID), object, reqData); err != nil {
+		sendError(w, fmt.Sprintf("Unable to register the upload: %+v", err), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Signed upload url for %s", reqData.File)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(UploadURLResponse{
+		URL:     signedURL,
+		Method:  http.MethodPut,
+		Headers: map[string]string{"Content-Type": contentType},
+		Expires: expires.UTC(),
+		File:    reqData.File,
+	})
+}
@@ -0,0 +1,65 @@
+package stt
+
+import (
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_uploadObjectName(t *testing.T) {
+	name, err := uploadObjectName("sermon.mp3", "20211018-ab")
+	assert.Nil(t, err)
+	assert.Equal(t, "uploads/20211018-ab/sermon.mp3", name)
+	assert.False(t, isInternalObject(name))
+	assert.Equal(t, "uploads/20211018-ab/sermon.json", sidecarNames(name)[0])
+
+	// Paths from the client are not used
+	name, err = uploadObjectName("../status/C:\\Users\\me\\sermon.wav", "id")
+	assert.Nil(t, err)
+	assert.Equal(t, "uploads/id/sermon.wav", name)
+
+	_, err = uploadObjectName("", "id")
+	assert.NotNil(t, err)
+
+	_, err = uploadObjectName("notes.txt", "id")
+	assert.NotNil(t, err)
+}
+
+func Test_parseUploadURLExpiry(t *testing.T) {
+	assert.Equal(t, 15*time.Minute, parseUploadURLExpiry("15m"))
+	assert.Equal(t, time.Hour, parseUploadURLExpiry("soon"))
+	assert.Equal(t, MaxUploadURLExpiry, parseUploadURLExpiry("720h"))
+}
+
+func Test_unusedSidecars(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-uploadURLExpiry - uploadGrace - time.Minute)
+	objs := []*storage.ObjectAttrs{
+		// Uploaded, the job is running
+		{Name: "uploads/a/sermon.json", Created: old},
+		{Name: "uploads/a/sermon.mp3", Created: old},
+		// Never uploaded
+		{Name: "uploads/b/sermon.json", Created: old},
+		// The upload may still be running
+		{Name: "uploads/c/sermon.json", Created: now.Add(-uploadURLExpiry - time.Minute)},
+	}
+	assert.Equal(t, []string{"uploads/b/sermon.json"}, unusedSidecars(objs, now))
+}
+
+func Test_allowedOrigin(t *testing.T) {
+	origins := uploadOrigins
+	defer func() { uploadOrigins = origins }()
+
+	uploadOrigins = []string{"*"}
+	assert.Equal(t, "*", allowedOrigin("https://app.example.com"))
+
+	uploadOrigins = []string{"https://app.example.com", " https://admin.example.com"}
+	assert.Equal(t, "https://admin.example.com", allowedOrigin("https://admin.example.com"))
+	assert.Equal(t, "", allowedOrigin("https://evil.example.com"))
+	assert.Equal(t, "", allowedOrigin(""))
+
+	uploadOrigins = []string{""}
+	assert.Equal(t, "", allowedOrigin("https://app.example.com"))
+}
@@ -0,0 +1,265 @@
+package stt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/asticode/go-astisub"
+)
+
+// versionsPrefix is where the transcript versions are stored in the result bucket
+const versionsPrefix = "versions/"
+
+// Sources of transcript versions
+const (
+	VersionRecognition = "recognition"
+	VersionImport      = "import"
+)
+
+// TranscriptVersion is a stored version of the JSON output
+type TranscriptVersion struct {
+	Version int       `json:"version"`
+	File    string    `json:"file"`
+	Source  string    `json:"source"`
+	By      string    `json:"by"`
+	At      time.Time `json:"at"`
+}
+
+// importableStatuses are the statuses in which corrected subtitles are accepted
+var importableStatuses = map[string]bool{
+	StatusTranscribed: true,
+	StatusNeedsReview: true,
+	StatusInReview:    true,
+}
+
+// addVersion records the next version of the transcript in the status. Its file is stored with copyVersion.
+func addVersion(fileStatus *FileStatus, source, by string) TranscriptVersion {
+	version := TranscriptVersion{
+		Version: len(fileStatus.Versions) + 1,
+		Source:  source,
+		By:      by,
+		At:      time.Now().UTC(),
+	}
+	version.File = fmt.Sprintf("%s%s/v%d.json", versionsPrefix, fileStatus.SourceFile, version.Version)
+
+	fileStatus.Versions = append(fileStatus.Versions, version)
+	return version
+}
+
+// copyVersion stores a copy of the current JSON output as the file of version
+func copyVersion(ctx context.Context, resultBucket *storage.BucketHandle, fileStatus FileStatus, version TranscriptVersion) error {
+	dst := resultBucket.Object(version.File)
+	_, err := dst.CopierFrom(resultBucket.Object(fileStatus.JSONFile)).Run(ctx)
+	return err
+}
+
+// readTranscript loads a JSON output from the result bucket
+func readTranscript(ctx context.Context, obj *storage.ObjectHandle) (Transcript, error) {
+	transcript := Transcript{}
+
+	reader, err := obj.NewReader(ctx)
+	if err != nil {
+		return transcript, err
+	}
+	defer reader.Close()
+
+	err = json.NewDecoder(reader).Decode(&transcript)
+	return transcript, err
+}
+
+// readSubtitles parses SRT or WebVTT, depending on the format or, if it is empty, the content
+func readSubtitles(data []byte, format string) (*astisub.Subtitles, error) {
+	if format == "" {
+		format = "srt"
+		if bytes.HasPrefix(bytes.TrimLeft(data, "\ufeff \r\n"), []byte("WEBVTT")) {
+			format = "vtt"
+		}
+	}
+
+	switch strings.ToLower(format) {
+	case "srt":
+		return astisub.ReadFromSRT(bytes.NewReader(data))
+	case "vtt", "webvtt":
+		return astisub.ReadFromWebVTT(bytes.NewReader(data))
+	}
+
+	return nil, fmt.Errorf("Unknown subtitle format: \"%s\"", format)
+}
+
+// ImportSubtitles stores corrected subtitles as a new version of the transcript.
+// The body is the SRT or WebVTT file, the job is selected with the "file" parameter.
+func ImportSubtitles(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	query := r.URL.Query()
+
+	if query.Get("key") != apiKey {
+		sendError(w, "Wrong key", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		sendError(w, "Only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := query.Get("user")
+	if user == "" {
+		sendError(w, "Parameter user is required", http.StatusBadRequest)
+		return
+	}
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		sendError(w, "Error reading request", http.StatusBadRequest)
+		return
+	}
+
+	subs, err := readSubtitles(data, query.Get("format"))
+	if err != nil {
+		sendError(w, fmt.Sprintf("Unable to parse subtitles: %+v", err), http.StatusBadRequest)
+		return
+	}
+
+	storageClient, err := storage.NewClient(ctx)
+	if err != nil {
+		sendError(w, fmt.Sprintf("Unable to create a storage client: %+v", err), http.StatusInternalServerError)
+		return
+	}
+
+	statusFile, fileStatus, ok := fileStatusFromRequest(w, r, storageClient, query.Get("file"))
+	if !ok {
+		return
+	}
+
+	if !importableStatuses[fileStatus.Status] || fileStatus.JSONFile == "" {
+		sendError(w, fmt.Sprintf("Subtitles can not be imported in status \"%s\"", fileStatus.Status), http.StatusConflict)
+		return
+	}
+
+	// previous is the status the job is put back to if the import fails
+	previous := fileStatus
+	fileStatus.Versions = append([]TranscriptVersion{}, fileStatus.Versions...)
+	var recognition *TranscriptVersion
+	if len(fileStatus.Versions) == 0 {
+		// Keep the recognized transcript before it is overwritten
+		v := addVersion(&fileStatus, VersionRecognition, systemUser)
+		recognition = &v
+	}
+	addVersion(&fileStatus, VersionImport, user)
+
+	// Claim the new versions before anything is written, so an import that loses a race changes nothing
+	generation, err := writeStatusGeneration(ctx, statusFile, fileStatus)
+	if isConflict(err) {
+		sendError(w, "Status was changed by someone else, try again", http.StatusConflict)
+		return
+	} else if err != nil {
+		sendError(w, fmt.Sprintf("Unable to write status file: %+v", err), http.StatusInternalServerError)
+		return
+	}
+	statusFile = statusFile.If(storage.Conditions{GenerationMatch: generation})
+
+	fail := func(message string) {
+		if err := writeStatus(ctx, statusFile, previous); err != nil {
+			log.Printf("Unable to restore the status of %s after a failed import: %+v", fileStatus.SourceFile, err)
+		}
+		sendError(w, message, http.StatusInternalServerError)
+	}
+
+	resultBucket := storageClient.Bucket(resultBucketID)
+	if recognition != nil {
+		if err := copyVersion(ctx, resultBucket, fileStatus, *recognition); err != nil {
+			fail(fmt.Sprintf("Unable to save version: %+v", err))
+			return
+		}
+		// The recognized transcript is kept even if the import fails
+		previous.Versions = []TranscriptVersion{*recognition}
+	}
+
+	// Always align with the word timings of the recognition, not of an earlier import
+	recognized, err := readTranscript(ctx, resultBucket.Object(fileStatus.Versions[0].File))
+	if err != nil {
+		fail(fmt.Sprintf("Unable to read transcript: %+v", err))
+		return
+	}
+
+	// The statistics describe the recognition, imported words have no confidence.
+	// The subtitles are kept as they were imported instead of being split again.
+	confidence := fileStatus.Confidence
+	err = writeOutputsWithSubtitles(ctx, resultBucket, &fileStatus, importSubtitles(recognized, subs).results(), subs)
+	fileStatus.Confidence = confidence
+	if err != nil {
+		fail(fmt.Sprintf("Unable to write results: %+v", err))
+		return
+	}
+
+	if err := copyVersion(ctx, resultBucket, fileStatus, fileStatus.Versions[len(fileStatus.Versions)-1]); err != nil {
+		fail(fmt.Sprintf("Unable to save version: %+v", err))
+		return
+	}
+
+	err = writeStatus(ctx, statusFile, fileStatus)
+	if isConflict(err) {
+		sendError(w, "Status was changed by someone else while the subtitles were imported", http.StatusConflict)
+		return
+	} else if err != nil {
+		sendError(w, fmt.Sprintf("Unable to write status file: %+v", err), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("%s: imported version %d by %s", fileStatus.SourceFile, len(fileStatus.Versions), user)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fileStatus)
+}
+
+// Versions lists the transcript versions of the job for the "file" parameter,
+// or returns the transcript of the version in the "version" parameter
+func Versions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	query := r.URL.Query()
+
+	if query.Get("key") != apiKey {
+		sendError(w, "Wrong key", http.StatusUnauthorized)
+		return
+	}
+
+	storageClient, err := storage.NewClient(ctx)
+	if err != nil {
+		sendError(w, fmt.Sprintf("Unable to create a storage client: %+v", err), http.StatusInternalServerError)
+		return
+	}
+
+	_, fileStatus, ok := fileStatusFromRequest(w, r, storageClient, query.Get("file"))
+	if !ok {
+		return
+	}
+
+	if query.Get("version") == "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(fileStatus.Versions)
+		return
+	}
+
+	version, err := strconv.Atoi(query.Get("version"))
+	if err != nil || version < 1 || version > len(fileStatus.Versions) {
+		sendError(w, fmt.Sprintf("Unknown version: \"%s\"", query.Get("version")), http.StatusNotFound)
+		return
+	}
+
+	transcript, err := readTranscript(ctx, storageClient.Bucket(resultBucketID).Object(fileStatus.Versions[version-1].File))
+	if err != nil {
+		sendError(w, fmt.Sprintf("Unable to read transcript: %+v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(transcript)
+}
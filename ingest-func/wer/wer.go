@@ -0,0 +1,315 @@
+// Package wer evaluates the word error rate (WER) of transcripts.
+//
+// It is a port of utils/simple_wer_v2.py and produces the same numbers. The diagnosis HTML
+// has the same layout, but the words are HTML escaped, which the script does not do.
+package wer
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// ErrorType classifies a position of the alignment of a hypothesis with a reference
+type ErrorType string
+
+// Error types
+const (
+	None         ErrorType = "none"
+	Substitution ErrorType = "sub"
+	Deletion     ErrorType = "del"
+	Insertion    ErrorType = "ins"
+)
+
+var (
+	whitespaceRegexp        = regexp.MustCompile(`[\t\n]`)
+	punctuationBeforeSpace  = regexp.MustCompile(`[,.?!]+ `)
+	punctuationAtEnd        = regexp.MustCompile(`[,.?!]+$`)
+	punctuationAfterSpace   = regexp.MustCompile(` [,.?!]+`)
+	quotesAndBracketsRegexp = regexp.MustCompile(`["()\[\]]`)
+	repeatedSpacesRegexp    = regexp.MustCompile(` +`)
+	bracketedCommentsRegexp = regexp.MustCompile(`\[[\p{L}\p{N}_]+\]`)
+)
+
+// Preprocess normalizes case, punctuation and spaces before the WER calculation
+func Preprocess(txt string) string {
+	txt = whitespaceRegexp.ReplaceAllString(strings.ToLower(txt), " ")
+	txt = punctuationBeforeSpace.ReplaceAllString(txt, " ")
+	txt = punctuationAtEnd.ReplaceAllString(txt, " ")
+	txt = punctuationAfterSpace.ReplaceAllString(txt, " ")
+	txt = quotesAndBracketsRegexp.ReplaceAllString(txt, "")
+	return repeatedSpacesRegexp.ReplaceAllString(strings.TrimSpace(txt), " ")
+}
+
+// RemoveCommentsPreprocess removes comments in box brackets, like [music], and preprocesses the text
+func RemoveCommentsPreprocess(txt string) string {
+	return Preprocess(bracketedCommentsRegexp.ReplaceAllString(txt, ""))
+}
+
+// HighlightAlignedHTML returns an HTML element highlighting the difference between hyp and ref.
+// The hypothesis is struck through on green, the reference is on yellow.
+func HighlightAlignedHTML(hyp, ref string, errType ErrorType) string {
+	hyp = html.EscapeString(hyp)
+	ref = html.EscapeString(ref)
+
+	switch errType {
+	case None:
+		return fmt.Sprintf("%s ", hyp)
+	case Substitution:
+		return fmt.Sprintf(`<span style="background-color: greenyellow">
+        <del>%s</del></span><span style="background-color: yellow">
+        %s </span> `, hyp, ref)
+	case Deletion:
+		return fmt.Sprintf(`<span style="background-color: yellow">
+        %s</span> `, ref)
+	case Insertion:
+		return fmt.Sprintf(`<span style="background-color: greenyellow">
+        <del>%s</del> </span> `, hyp)
+	}
+
+	return ""
+}
+
+// EditDistanceMatrix computes the edit distances between the prefixes of the word lists.
+// The first index is the reference and the second the hypothesis.
+func EditDistanceMatrix(hyp, ref []string) [][]int {
+	m := make([][]int, len(ref)+1)
+	for i := range m {
+		m[i] = make([]int, len(hyp)+1)
+		m[i][0] = i
+	}
+	for j := range m[0] {
+		m[0][j] = j
+	}
+
+	for i := 1; i <= len(ref); i++ {
+		for j := 1; j <= len(hyp); j++ {
+			if ref[i-1] == hyp[j-1] {
+				m[i][j] = m[i-1][j-1]
+				continue
+			}
+
+			d := m[i-1][j-1] + 1
+			if m[i][j-1]+1 < d {
+				d = m[i][j-1] + 1
+			}
+			if m[i-1][j]+1 < d {
+				d = m[i-1][j] + 1
+			}
+			m[i][j] = d
+		}
+	}
+
+	return m
+}
+
+// Info counts the errors and the number of reference words
+type Info struct {
+	Substitutions int `json:"sub"`
+	Insertions    int `json:"ins"`
+	Deletions     int `json:"del"`
+	Words         int `json:"nw"`
+}
+
+// Errors is the total number of errors
+func (i Info) Errors() int {
+	return i.Substitutions + i.Insertions + i.Deletions
+}
+
+// WER is the word error rate as a percentage. It can be larger than 100 if there are many insertions.
+func (i Info) WER() float64 {
+	return float64(i.Errors()) * 100 / float64(nonZero(i.Words))
+}
+
+// Add sums the counts
+func (i Info) Add(o Info) Info {
+	return Info{
+		Substitutions: i.Substitutions + o.Substitutions,
+		Insertions:    i.Insertions + o.Insertions,
+		Deletions:     i.Deletions + o.Deletions,
+		Words:         i.Words + o.Words,
+	}
+}
+
+func nonZero(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// KeyPhraseStats measures how well the key phrases were recognized.
+// Jaccard is the Jaccard similarity (https://en.wikipedia.org/wiki/Jaccard_index) and F1 the F1 score
+// (https://en.wikipedia.org/wiki/Precision_and_recall) of the key phrases, both between 0 and 1.
+type KeyPhraseStats struct {
+	Jaccard float64
+	F1      float64
+	Matched int
+	Ref     int
+	Hyp     int
+}
+
+// Evaluator computes the word error rate over pairs of hypotheses and references
+type Evaluator struct {
+	// KeyPhrases are the preprocessed important phrases, if any
+	KeyPhrases   []string
+	AlignedHTMLs []string
+	Info         Info
+
+	RefKeyPhraseCounts     map[string]int
+	HypKeyPhraseCounts     map[string]int
+	MatchedKeyPhraseCounts map[string]int
+
+	// HTMLHandler generates the diagnosis HTML, nil disables it
+	HTMLHandler func(hyp, ref string, errType ErrorType) string
+	// PreprocessHandler prepares the texts, nil disables preprocessing
+	PreprocessHandler func(string) string
+}
+
+// New returns an Evaluator with the default preprocessing and HTML output.
+// No key phrase statistics are computed if keyPhrases is empty.
+func New(keyPhrases []string) *Evaluator {
+	e := &Evaluator{
+		HTMLHandler:       HighlightAlignedHTML,
+		PreprocessHandler: RemoveCommentsPreprocess,
+	}
+
+	if len(keyPhrases) == 0 {
+		return e
+	}
+
+	e.RefKeyPhraseCounts = map[string]int{}
+	e.HypKeyPhraseCounts = map[string]int{}
+	e.MatchedKeyPhraseCounts = map[string]int{}
+	for _, k := range keyPhrases {
+		k = e.PreprocessHandler(k)
+		e.KeyPhrases = append(e.KeyPhrases, k)
+		e.RefKeyPhraseCounts[k] = 0
+		e.HypKeyPhraseCounts[k] = 0
+		e.MatchedKeyPhraseCounts[k] = 0
+	}
+
+	return e
+}
+
+// AddHypRef adds the errors of one pair of hypothesis and reference and returns them
+func (e *Evaluator) AddHypRef(hypothesis, reference string) (Info, error) {
+	if e.PreprocessHandler != nil {
+		hypothesis = e.PreprocessHandler(hypothesis)
+		reference = e.PreprocessHandler(reference)
+	}
+
+	hypWords := strings.Fields(hypothesis)
+	refWords := strings.Fields(reference)
+	distances := EditDistanceMatrix(hypWords, refWords)
+
+	// Back trace to tell the errors apart
+	posHyp, posRef := len(hypWords), len(refWords)
+	info := Info{Words: len(refWords)}
+	alignedHTML := ""
+	matchedRef := ""
+	for posHyp > 0 || posRef > 0 {
+		var errType ErrorType
+		switch {
+		case posRef == 0:
+			errType = Insertion
+		case posHyp == 0:
+			errType = Deletion
+		case hypWords[posHyp-1] == refWords[posRef-1]:
+			errType = None
+		case distances[posRef][posHyp] == distances[posRef-1][posHyp-1]+1:
+			errType = Substitution
+		case distances[posRef][posHyp] == distances[posRef-1][posHyp]+1:
+			errType = Deletion
+		case distances[posRef][posHyp] == distances[posRef][posHyp-1]+1:
+			errType = Insertion
+		default:
+			return info, fmt.Errorf("failed to parse edit distance matrix")
+		}
+
+		if e.HTMLHandler != nil {
+			hyp, ref := " ", " "
+			if posHyp > 0 {
+				hyp = hypWords[posHyp-1]
+			}
+			if posRef > 0 {
+				ref = refWords[posRef-1]
+			}
+			alignedHTML = e.HTMLHandler(hyp, ref, errType) + alignedHTML
+		}
+
+		switch errType {
+		case None:
+			matchedRef = hypWords[posHyp-1] + " " + matchedRef
+			posHyp, posRef = posHyp-1, posRef-1
+		case Deletion:
+			info.Deletions++
+			posRef--
+		case Insertion:
+			info.Insertions++
+			posHyp--
+		case Substitution:
+			info.Substitutions++
+			posHyp, posRef = posHyp-1, posRef-1
+		}
+	}
+
+	if distances[len(refWords)][len(hypWords)] != info.Errors() {
+		return info, fmt.Errorf("back trace found %d errors, the edit distance is %d", info.Errors(), distances[len(refWords)][len(hypWords)])
+	}
+
+	e.Info = e.Info.Add(info)
+	if e.HTMLHandler != nil {
+		e.AlignedHTMLs = append(e.AlignedHTMLs, alignedHTML)
+	}
+
+	for _, k := range e.KeyPhrases {
+		e.RefKeyPhraseCounts[k] += strings.Count(reference, k)
+		e.HypKeyPhraseCounts[k] += strings.Count(hypothesis, k)
+		e.MatchedKeyPhraseCounts[k] += strings.Count(matchedRef, k)
+	}
+
+	return info, nil
+}
+
+// WER is the word error rate of all added pairs as a percentage
+func (e *Evaluator) WER() float64 {
+	return e.Info.WER()
+}
+
+// KeyPhraseStats measures the key phrases of all added pairs
+func (e *Evaluator) KeyPhraseStats() KeyPhraseStats {
+	s := KeyPhraseStats{}
+	for _, k := range e.KeyPhrases {
+		s.Matched += e.MatchedKeyPhraseCounts[k]
+		s.Ref += e.RefKeyPhraseCounts[k]
+		s.Hyp += e.HypKeyPhraseCounts[k]
+	}
+
+	s.Jaccard = float64(s.Matched) / float64(nonZero(s.Ref+s.Hyp-s.Matched))
+	s.F1 = 2 * float64(s.Matched) / float64(nonZero(s.Ref+s.Hyp))
+	return s
+}
+
+// Summaries describes the total errors, the error types and the key phrase statistics
+func (e *Evaluator) Summaries() (string, string, string) {
+	words := float64(nonZero(e.Info.Words))
+	summary := fmt.Sprintf("total WER = %d, total word = %d, wer = %.2f%%", e.Info.Errors(), e.Info.Words, e.WER())
+	details := fmt.Sprintf("Error breakdown: del = %.2f%%, ins=%.2f%%, sub=%.2f%%",
+		float64(e.Info.Deletions)*100/words, float64(e.Info.Insertions)*100/words, float64(e.Info.Substitutions)*100/words)
+
+	keyPhrases := ""
+	if len(e.KeyPhrases) > 0 {
+		s := e.KeyPhraseStats()
+		keyPhrases = fmt.Sprintf("matched %d key phrases (%d in ref, %d in hyp), jaccard similarity=%.2f, F1=%.2f",
+			s.Matched, s.Ref, s.Hyp, s.Jaccard, s.F1)
+	}
+
+	return summary, details, keyPhrases
+}
+
+// DiagnosisHTML is the page with the aligned pairs, as written by simple_wer_v2.py
+func (e *Evaluator) DiagnosisHTML() string {
+	return fmt.Sprintf("<body><html><div>%s</div></body></html>", strings.Join(e.AlignedHTMLs, "<br>"))
+}
@@ -0,0 +1,45 @@
+package wer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Preprocess(t *testing.T) {
+	assert.Equal(t, "god morgen alle sammen velkommen", Preprocess("God morgen,\talle sammen!\n \"Velkommen\"."))
+	assert.Equal(t, "vi synger 24", RemoveCommentsPreprocess("Vi synger [musikk] 24"))
+}
+
+// The expected values are the output of utils/simple_wer_v2.py for the same texts
+func Test_Evaluator(t *testing.T) {
+	e := New([]string{"Brunstad", "god morgen"})
+
+	info, err := e.AddHypRef("God morgen alle, velkommen til brun stad [musikk]", "God morgen, alle sammen! Velkommen til Brunstad.")
+	assert.Nil(t, err)
+	assert.Equal(t, Info{Substitutions: 1, Insertions: 1, Deletions: 1, Words: 7}, info)
+
+	_, err = e.AddHypRef("Vi synger (sang) 24", "Vi synger sang 24 i dag")
+	assert.Nil(t, err)
+
+	assert.Equal(t, Info{Substitutions: 1, Insertions: 1, Deletions: 3, Words: 13}, e.Info)
+	assert.InDelta(t, 38.4615, e.WER(), 0.001)
+	assert.Equal(t, KeyPhraseStats{Jaccard: 0.5, F1: 2.0 / 3, Matched: 1, Ref: 2, Hyp: 1}, e.KeyPhraseStats())
+
+	summary, details, keyPhrases := e.Summaries()
+	assert.Equal(t, "total WER = 5, total word = 13, wer = 38.46%", summary)
+	assert.Equal(t, "Error breakdown: del = 23.08%, ins=7.69%, sub=7.69%", details)
+	assert.Equal(t, "matched 1 key phrases (2 in ref, 1 in hyp), jaccard similarity=0.50, F1=0.67", keyPhrases)
+
+	assert.Equal(t, "vi synger sang 24 <span style=\"background-color: yellow\">\n        i</span> <span style=\"background-color: yellow\">\n        dag</span> ", e.AlignedHTMLs[1])
+}
+
+func Test_Evaluator_empty(t *testing.T) {
+	e := New(nil)
+	_, err := e.AddHypRef("", "")
+	assert.Nil(t, err)
+	assert.Equal(t, 0.0, e.WER())
+
+	_, _, keyPhrases := e.Summaries()
+	assert.Equal(t, "", keyPhrases)
+}
@@ -0,0 +1,255 @@
+package stt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// systemUser is recorded for the transitions made by the functions themselves
+const systemUser = "system"
+
+// statusSuffixes are the names a status file can have, see renameStatus
+var statusSuffixes = []string{"", ".done", ".error"}
+
+// transitions lists the statuses a job can move to from each status
+var transitions = map[string][]string{
+	"":                {StatusQueued, StatusProcessing},
+	StatusQueued:      {StatusProcessing, StatusError, StatusCancelled},
+	StatusProcessing:  {StatusTranscribed, StatusNeedsReview, StatusError, StatusCancelled, StatusQueued},
+	StatusTranscribed: {StatusInReview},
+	StatusNeedsReview: {StatusInReview},
+	StatusInReview:    {StatusApproved, StatusNeedsReview},
+	StatusApproved:    {StatusPublished, StatusInReview},
+	StatusPublished:   {StatusInReview},
+	StatusError:       {StatusProcessing},
+	StatusCancelled:   {StatusProcessing},
+}
+
+// manualStatuses can be set by editors through the Transition endpoint,
+// the others are only set by the functions
+var manualStatuses = map[string]bool{
+	StatusNeedsReview: true,
+	StatusInReview:    true,
+	StatusApproved:    true,
+	StatusPublished:   true,
+}
+
+// StatusChange records a change of the status of a job
+type StatusChange struct {
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	By      string    `json:"by"`
+	At      time.Time `json:"at"`
+	Comment string    `json:"comment,omitempty"`
+}
+
+// TransitionRequest is the body of the Transition endpoint
+type TransitionRequest struct {
+	File    string `json:"file"`
+	Status  string `json:"status"`
+	User    string `json:"user"`
+	Comment string `json:"comment"`
+}
+
+func canTransition(from, to string) bool {
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// setStatus moves the job to a new status and records who did it
+func (s *FileStatus) setStatus(to, by, comment string) error {
+	if !canTransition(s.Status, to) {
+		return fmt.Errorf("Can not change status from \"%s\" to \"%s\"", s.Status, to)
+	}
+
+	s.History = append(s.History, StatusChange{
+		From:    s.Status,
+		To:      to,
+		By:      by,
+		At:      time.Now().UTC(),
+		Comment: comment,
+	})
+	s.Status = to
+	return nil
+}
+
+// fail moves the job to StatusError. Errors can happen in any status
+func (s *FileStatus) fail(err error) {
+	s.Error = err.Error()
+	s.History = append(s.History, StatusChange{
+		From:    s.Status,
+		To:      StatusError,
+		By:      systemUser,
+		At:      time.Now().UTC(),
+		Comment: s.Error,
+	})
+	s.Status = StatusError
+}
+
+// decodeStatus parses a status file, converting the statuses used by older versions
+func decodeStatus(data []byte) (FileStatus, error) {
+	fileStatus := FileStatus{}
+	if err := json.Unmarshal(data, &fileStatus); err != nil {
+		return fileStatus, err
+	}
+
+	if fileStatus.Status == StatusCompleted {
+		fileStatus.Status = StatusTranscribed
+	}
+
+	return fileStatus, nil
+}
+
+// findStatus reads the status file of a source file, wherever it is in the workflow.
+// The returned handle only overwrites the status file if it was not changed in the meantime.
+func findStatus(ctx context.Context, bucket *storage.BucketHandle, sourceFile string) (*storage.ObjectHandle, FileStatus, error) {
+	for _, suffix := range statusSuffixes {
+		obj := bucket.Object(fmt.Sprintf("status/%s.json%s", sourceFile, suffix))
+		reader, err := obj.NewReader(ctx)
+		if err == storage.ErrObjectNotExist {
+			continue
+		} else if err != nil {
+			return nil, FileStatus{}, err
+		}
+
+		data, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return nil, FileStatus{}, err
+		}
+
+		fileStatus, err := decodeStatus(data)
+		if err != nil {
+			return nil, fileStatus, err
+		}
+
+		return obj.If(storage.Conditions{GenerationMatch: reader.Attrs.Generation}), fileStatus, nil
+	}
+
+	return nil, FileStatus{}, storage.ErrObjectNotExist
+}
+
+// isConflict is true if a conditional write failed because the object was changed
+func isConflict(err error) bool {
+	apiErr, ok := err.(*googleapi.Error)
+	return ok && apiErr.Code == http.StatusPreconditionFailed
+}
+
+// fileStatusFromRequest finds the status of the gs:// url in file and sends an error response if that fails
+func fileStatusFromRequest(w http.ResponseWriter, r *http.Request, storageClient *storage.Client, file string) (*storage.ObjectHandle, FileStatus, bool) {
+	ctx := r.Context()
+
+	fileURL, err := url.Parse(file)
+	if err != nil || fileURL.Hostname() == "" {
+		sendError(w, fmt.Sprintf("Unable to parse file url: \"%s\"", file), http.StatusBadRequest)
+		return nil, FileStatus{}, false
+	}
+
+	bucket := storageClient.Bucket(fileURL.Hostname())
+	statusFile, fileStatus, err := findStatus(ctx, bucket, strings.TrimPrefix(fileURL.Path, "/"))
+	if err == storage.ErrObjectNotExist {
+		sendError(w, fmt.Sprintf("No job for \"%s\"", file), http.StatusNotFound)
+		return nil, fileStatus, false
+	} else if err != nil {
+		sendError(w, fmt.Sprintf("Unable to read status file: %+v", err), http.StatusInternalServerError)
+		return nil, fileStatus, false
+	}
+
+	return statusFile, fileStatus, true
+}
+
+// Status returns the status of the job for the file in the "file" parameter
+func Status(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("key") != apiKey {
+		sendError(w, "Wrong key", http.StatusUnauthorized)
+		return
+	}
+
+	storageClient, err := storage.NewClient(r.Context())
+	if err != nil {
+		sendError(w, fmt.Sprintf("Unable to create a storage client: %+v", err), http.StatusInternalServerError)
+		return
+	}
+
+	_, fileStatus, ok := fileStatusFromRequest(w, r, storageClient, r.URL.Query().Get("file"))
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fileStatus)
+}
+
+// Transition changes the review status of a job
+func Transition(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.URL.Query().Get("key") != apiKey {
+		sendError(w, "Wrong key", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		sendError(w, "Only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	reqData := TransitionRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&reqData); err != nil {
+		sendError(w, "Error parsing request", http.StatusBadRequest)
+		return
+	}
+
+	if reqData.User == "" {
+		sendError(w, "Field user is required", http.StatusBadRequest)
+		return
+	}
+
+	if !manualStatuses[reqData.Status] {
+		sendError(w, fmt.Sprintf("Status \"%s\" can not be set manually", reqData.Status), http.StatusBadRequest)
+		return
+	}
+
+	storageClient, err := storage.NewClient(ctx)
+	if err != nil {
+		sendError(w, fmt.Sprintf("Unable to create a storage client: %+v", err), http.StatusInternalServerError)
+		return
+	}
+
+	statusFile, fileStatus, ok := fileStatusFromRequest(w, r, storageClient, reqData.File)
+	if !ok {
+		return
+	}
+
+	if err := fileStatus.setStatus(reqData.Status, reqData.User, reqData.Comment); err != nil {
+		sendError(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	err = writeStatus(ctx, statusFile, fileStatus)
+	if isConflict(err) {
+		sendError(w, "Status was changed by someone else, try again", http.StatusConflict)
+		return
+	} else if err != nil {
+		sendError(w, fmt.Sprintf("Unable to write status file: %+v", err), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("%s: %s by %s", fileStatus.SourceFile, fileStatus.Status, reqData.User)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fileStatus)
+}
@@ -0,0 +1,39 @@
+package stt
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_setStatus(t *testing.T) {
+	s := FileStatus{}
+	assert.NoError(t, s.setStatus(StatusProcessing, systemUser, ""))
+	assert.NoError(t, s.setStatus(StatusTranscribed, systemUser, ""))
+	assert.Error(t, s.setStatus(StatusPublished, "editor", ""))
+	assert.NoError(t, s.setStatus(StatusInReview, "editor", ""))
+	assert.NoError(t, s.setStatus(StatusApproved, "reviewer", "Looks good"))
+	assert.NoError(t, s.setStatus(StatusPublished, "reviewer", ""))
+
+	assert.Equal(t, StatusPublished, s.Status)
+	assert.Len(t, s.History, 5)
+	assert.Equal(t, StatusChange{From: StatusInReview, To: StatusApproved, By: "reviewer", At: s.History[3].At, Comment: "Looks good"}, s.History[3])
+}
+
+func Test_fail(t *testing.T) {
+	s := FileStatus{}
+	s.setStatus(StatusProcessing, systemUser, "")
+	s.fail(fmt.Errorf("Operation failed"))
+
+	assert.Equal(t, StatusError, s.Status)
+	assert.Equal(t, "Operation failed", s.Error)
+	assert.Error(t, s.setStatus(StatusInReview, "editor", ""))
+}
+
+func Test_decodeStatus(t *testing.T) {
+	s, err := decodeStatus([]byte(`{"status": "completed", "source": "a.wav"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, StatusTranscribed, s.Status)
+	assert.Equal(t, "a.wav", s.SourceFile)
+}